@@ -0,0 +1,142 @@
+package web
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/bamgoo/base"
+)
+
+const defaultAccessLogFormat = `$ip - [$time] "$method $uri" $status $size $duration "$ua"`
+
+type (
+	// accessLog writes access logs, see Setting["accesslog"].
+	accessLog struct {
+		format string
+		sample int64
+		count  atomic.Int64
+		logger *log.Logger
+	}
+
+	// httpStatusWriter records the final status and size of a response.
+	httpStatusWriter struct {
+		http.ResponseWriter
+		code int
+		size int64
+	}
+)
+
+// newAccessLog parses access log setting, it accepts true, a format
+// string, or a map with format, output and sample keys.
+func newAccessLog(setting Any) *accessLog {
+	conf := Map{}
+	switch v := setting.(type) {
+	case bool:
+		if !v {
+			return nil
+		}
+	case string:
+		conf["format"] = v
+	case Map:
+		conf = v
+	default:
+		return nil
+	}
+
+	alog := &accessLog{format: defaultAccessLogFormat, sample: 1}
+	if v, ok := conf["format"].(string); ok && v != "" {
+		alog.format = v
+	}
+	if v := parseInt(conf["sample"]); v > 1 {
+		alog.sample = int64(v)
+	}
+
+	var output io.Writer = os.Stdout
+	if v, ok := conf["output"].(string); ok && v != "" {
+		switch v {
+		case "stdout":
+		case "stderr":
+			output = os.Stderr
+		default:
+			output = accessLogFile(v)
+		}
+	}
+	alog.logger = log.New(output, "", 0)
+
+	return alog
+}
+
+// accessLogFiles keeps the opened outputs by path, sites are rebuilt on
+// reconfigure and route removal but share the file.
+var accessLogFiles sync.Map
+
+func accessLogFile(name string) *os.File {
+	if file, ok := accessLogFiles.Load(name); ok {
+		return file.(*os.File)
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		panic("Invalid web access log: " + err.Error())
+	}
+	if opened, loaded := accessLogFiles.LoadOrStore(name, file); loaded {
+		file.Close()
+		return opened.(*os.File)
+	}
+	return file
+}
+
+func (w *httpStatusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *httpStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *httpStatusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (alog *accessLog) log(ctx *Context, writer *httpStatusWriter, start time.Time) {
+	if alog.count.Add(1)%alog.sample != 0 {
+		return
+	}
+	alog.logger.Println(alog.line(ctx, writer, start))
+}
+
+func (alog *accessLog) line(ctx *Context, writer *httpStatusWriter, start time.Time) string {
+	code := writer.code
+	if code == 0 {
+		code = ctx.Code
+	}
+	return strings.NewReplacer(
+		"$method", ctx.Method,
+		"$path", ctx.Path,
+		"$uri", ctx.Uri,
+		"$status", strconv.Itoa(code),
+		"$size", strconv.FormatInt(writer.size, 10),
+		"$duration", time.Since(start).String(),
+		"$ip", ctx.IP(),
+		"$ua", ctx.Agent(),
+		"$referer", ctx.reader.Referer(),
+		"$host", ctx.Host,
+		"$site", ctx.site.Name,
+		"$route", ctx.Name,
+		"$time", start.Format(time.RFC3339),
+	).Replace(alog.format)
+}
@@ -0,0 +1,17 @@
+package web
+
+import (
+	"path/filepath"
+	"testing"
+
+	. "github.com/bamgoo/base"
+)
+
+func TestAccessLogReusesOutput(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "access.log")
+	first := newAccessLog(Map{"output": output})
+	second := newAccessLog(Map{"output": output})
+	if first.logger.Writer() != second.logger.Writer() {
+		t.Error("rebuilt access logs should share the output file")
+	}
+}
@@ -0,0 +1,102 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/bamgoo/bamgoo"
+	. "github.com/bamgoo/base"
+)
+
+// AuthVerify verifies credentials of a scheme, user is empty for bearer.
+type AuthVerify func(scheme, user, secret string) (Any, bool)
+
+// AuthFilter returns a basic/bearer auth filter for simple internal tools.
+// Credentials come from site Setting["auth"], like
+//
+//	auth = { realm = "admin", users = { admin = "secret" }, tokens = ["xxx"] }
+//
+// or the verify callback if given. The identity goes into ctx.Locals["auth"].
+func AuthFilter(verify ...AuthVerify) Filter {
+	var verifier AuthVerify
+	if len(verify) > 0 {
+		verifier = verify[0]
+	}
+	return Filter{
+		Name: "auth",
+		Desc: "basic and bearer auth",
+		Request: func(ctx *Context) {
+			conf, _ := ctx.site.Setting["auth"].(Map)
+
+			scheme, credentials := ctx.authorization()
+			identity, ok := Any(nil), false
+			switch strings.ToLower(scheme) {
+			case "basic":
+				if raw, err := base64.StdEncoding.DecodeString(credentials); err == nil {
+					if user, pass, found := strings.Cut(string(raw), ":"); found {
+						identity, ok = authVerify(verifier, conf, "basic", user, pass)
+					}
+				}
+			case "bearer":
+				identity, ok = authVerify(verifier, conf, "bearer", "", credentials)
+			}
+
+			if !ok {
+				realm := "restricted"
+				if vv, ok := conf["realm"].(string); ok && vv != "" {
+					realm = vv
+				}
+				ctx.Header("WWW-Authenticate", authChallenge(verifier, conf, scheme, realm))
+				ctx.Code = StatusUnauthorized
+				ctx.Denied(bamgoo.Unauthed)
+				return
+			}
+
+			ctx.Locals["auth"] = identity
+			ctx.Next()
+		},
+	}
+}
+
+// authChallenge is Bearer for bearer requests, otherwise the schemes in
+// use: Basic for users, Bearer for tokens, both for a verifier.
+func authChallenge(verifier AuthVerify, conf Map, scheme, realm string) string {
+	basic := `Basic realm="` + realm + `"`
+	bearer := `Bearer realm="` + realm + `"`
+	if strings.EqualFold(scheme, "bearer") {
+		return bearer
+	}
+	users, _ := conf["users"].(Map)
+	tokens := parseStringList(conf["tokens"])
+	switch {
+	case verifier != nil || len(users) > 0 && len(tokens) > 0:
+		return basic + ", " + bearer
+	case len(tokens) > 0:
+		return bearer
+	}
+	return basic
+}
+
+func authVerify(verifier AuthVerify, conf Map, scheme, user, secret string) (Any, bool) {
+	if verifier != nil {
+		return verifier(scheme, user, secret)
+	}
+	if conf == nil || secret == "" {
+		return nil, false
+	}
+	if scheme == "basic" {
+		users, _ := conf["users"].(Map)
+		if pass, ok := users[user].(string); ok && pass != "" &&
+			subtle.ConstantTimeCompare([]byte(pass), []byte(secret)) == 1 {
+			return user, true
+		}
+		return nil, false
+	}
+	for _, token := range parseStringList(conf["tokens"]) {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			return token, true
+		}
+	}
+	return nil, false
+}
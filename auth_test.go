@@ -0,0 +1,52 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/bamgoo/base"
+)
+
+func TestAuthChallenge(t *testing.T) {
+	users := Map{"admin": "secret"}
+	tokens := []string{"xxx"}
+	cases := []struct {
+		name   string
+		auth   Map
+		header string
+		code   int
+		want   string
+	}{
+		{"users", Map{"users": users}, "", http.StatusUnauthorized, `Basic realm="admin"`},
+		{"tokens", Map{"tokens": tokens}, "", http.StatusUnauthorized, `Bearer realm="admin"`},
+		{"both", Map{"users": users, "tokens": tokens}, "", http.StatusUnauthorized, `Basic realm="admin", Bearer realm="admin"`},
+		{"bearer", Map{"users": users, "tokens": tokens}, "Bearer wrong", http.StatusUnauthorized, `Bearer realm="admin"`},
+		{"token", Map{"tokens": tokens}, "Bearer xxx", http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.auth["realm"] = "admin"
+			m := newTestModule()
+			m.RegisterDriver("test", &testDriver{&testConnect{routes: map[string]Info{}}})
+			m.RegisterFilter("auth", AuthFilter())
+			m.RegisterRouter("admin", Router{Uri: "/admin", Method: GET, Action: func(ctx *Context) { ctx.Text("ok") }})
+			m.Config(Map{"web": Map{"setting": Map{"auth": c.auth}}})
+			m.Setup()
+			m.Open()
+
+			req := httptest.NewRequest(GET, "/admin", nil)
+			if c.header != "" {
+				req.Header.Set("Authorization", c.header)
+			}
+			res := httptest.NewRecorder()
+			m.Serve("default.admin.*", Map{}, res, req)
+			if res.Code != c.code {
+				t.Errorf("status = %d, want %d", res.Code, c.code)
+			}
+			if got := res.Header().Get("WWW-Authenticate"); got != c.want {
+				t.Errorf("challenge = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
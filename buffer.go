@@ -0,0 +1,32 @@
+package web
+
+import (
+	"sync"
+)
+
+const defaultCopyBufferSize = 32 * 1024
+
+// bufferPools pools copy buffers by size, sites may differ in size.
+var bufferPools sync.Map
+
+// copyBuffer takes a pooled buffer of Config.CopyBufferSize, give it back
+// with releaseBuffer.
+func (site *Site) copyBuffer() *[]byte {
+	size := site.Config.CopyBufferSize
+	if size <= 0 {
+		size = defaultCopyBufferSize
+	}
+	pool, _ := bufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() any {
+			buffer := make([]byte, size)
+			return &buffer
+		},
+	})
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+func releaseBuffer(buffer *[]byte) {
+	if pool, ok := bufferPools.Load(len(*buffer)); ok {
+		pool.(*sync.Pool).Put(buffer)
+	}
+}
@@ -0,0 +1,275 @@
+package web
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCacheSize = 1024
+
+type (
+	// httpCache is a bounded LRU cache of serialized responses.
+	httpCache struct {
+		mutex sync.Mutex
+		size  int
+		items map[string]*list.Element
+		order *list.List
+	}
+
+	httpCacheEntry struct {
+		key    string
+		code   int
+		header http.Header
+		body   []byte
+		expire time.Time
+	}
+
+	httpCachedBody struct {
+		entry *httpCacheEntry
+	}
+
+	// httpCacheWriter records the response while writing it through.
+	httpCacheWriter struct {
+		http.ResponseWriter
+		code   int
+		buffer bytes.Buffer
+	}
+)
+
+// cacheSkipHeaders are per request, so left out of cached responses.
+var cacheSkipHeaders = []string{"Set-Cookie", "Date", "Server-Timing", "Traceparent", "Tracestate", "Content-Security-Policy"}
+
+// fileETagMaxSize caps the files hashed for an etag, larger ones get a
+// weak etag of their modtime and size.
+const fileETagMaxSize = 8 << 20
+
+var (
+	fileETags sync.Map
+
+	// fileHashing dedupes concurrent hashing of a path.
+	fileHashing      = map[string]*fileHash{}
+	fileHashingMutex sync.Mutex
+)
+
+type (
+	fileETag struct {
+		modtime time.Time
+		size    int64
+		etag    string
+	}
+
+	fileHash struct {
+		done chan struct{}
+		etag string
+	}
+)
+
+// fileETagOf returns a strong content hash etag, cached by path, modtime and
+// size. Concurrent requests for a path share one hashing.
+func fileETagOf(file string) string {
+	stat, err := os.Stat(file)
+	if err != nil || stat.IsDir() {
+		return ""
+	}
+	if stat.Size() > fileETagMaxSize {
+		return fmt.Sprintf(`W/"%x-%x"`, stat.ModTime().UnixNano(), stat.Size())
+	}
+	if vv, ok := fileETags.Load(file); ok {
+		cached := vv.(fileETag)
+		if cached.size == stat.Size() && cached.modtime.Equal(stat.ModTime()) {
+			return cached.etag
+		}
+	}
+
+	fileHashingMutex.Lock()
+	if hashing, ok := fileHashing[file]; ok {
+		fileHashingMutex.Unlock()
+		<-hashing.done
+		return hashing.etag
+	}
+	hashing := &fileHash{done: make(chan struct{})}
+	fileHashing[file] = hashing
+	fileHashingMutex.Unlock()
+
+	defer func() {
+		fileHashingMutex.Lock()
+		delete(fileHashing, file)
+		fileHashingMutex.Unlock()
+		close(hashing.done)
+	}()
+
+	hashing.etag = hashFile(file)
+	if hashing.etag != "" {
+		fileETags.Store(file, fileETag{stat.ModTime(), stat.Size(), hashing.etag})
+	}
+	return hashing.etag
+}
+
+func hashFile(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return ""
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+func newHttpCache(size int) *httpCache {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	return &httpCache{
+		size:  size,
+		items: make(map[string]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+func (c *httpCache) get(key string) *httpCacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*httpCacheEntry)
+	if time.Now().After(entry.expire) {
+		c.order.Remove(elem)
+		delete(c.items, key)
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return entry
+}
+
+func (c *httpCache) set(entry *httpCacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.items[entry.key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.items, last.Value.(*httpCacheEntry).key)
+	}
+}
+
+func (w *httpCacheWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *httpCacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *httpCacheWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = StatusOK
+	}
+	w.buffer.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// caching serves GET responses from the route cache, see Setting["cache"].
+func (site *Site) caching(ctx *Context) {
+	if ctx.Method != GET || ctx.Setting == nil {
+		ctx.Next()
+		return
+	}
+	ttl := parseDuration(ctx.Setting["cache"])
+	if ttl <= 0 || site.credentialed(ctx) {
+		ctx.Next()
+		return
+	}
+
+	key := ctx.Name + " " + ctx.reader.RequestURI
+	for _, name := range parseStringList(ctx.Setting["vary"]) {
+		key += "\n" + strings.ToLower(name) + ":" + ctx.reader.Header.Get(name)
+	}
+
+	if entry := site.cache.get(key); entry != nil {
+		ctx.Code = entry.code
+		ctx.Body = httpCachedBody{entry}
+		return
+	}
+
+	ctx.cacheKey = key
+	ctx.cacheTTL = ttl
+	ctx.Next()
+}
+
+// credentialed reports requests with an Authorization header, a token
+// or the session cookie, their responses are per user and never cached.
+func (site *Site) credentialed(ctx *Context) bool {
+	if ctx.reader.Header.Get("Authorization") != "" || site.token(ctx) != "" {
+		return true
+	}
+	if name := site.Config.Cookie; name != "" {
+		if _, err := ctx.reader.Cookie(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyCached replays the stored response, headers of this request like
+// its request id win over the stored ones.
+func (site *Site) bodyCached(ctx *Context, body httpCachedBody) {
+	res := ctx.writer
+	for key, vals := range body.entry.header {
+		if _, ok := res.Header()[key]; !ok {
+			res.Header()[key] = vals
+		}
+	}
+	res.WriteHeader(body.entry.code)
+	res.Write(body.entry.body)
+}
+
+func (site *Site) cached(ctx *Context, writer *httpCacheWriter) {
+	if writer.code != StatusOK {
+		return
+	}
+	control := strings.ToLower(writer.Header().Get("Cache-Control"))
+	if strings.Contains(control, "private") || strings.Contains(control, "no-store") {
+		return
+	}
+
+	// Headers of the request itself aren't replayed.
+	header := writer.Header().Clone()
+	for _, name := range cacheSkipHeaders {
+		header.Del(name)
+	}
+	if name := site.Config.RequestId; name != "" {
+		header.Del(name)
+	}
+	site.cache.set(&httpCacheEntry{
+		key:    ctx.cacheKey,
+		code:   writer.code,
+		header: header,
+		body:   writer.buffer.Bytes(),
+		expire: time.Now().Add(ctx.cacheTTL),
+	})
+}
@@ -0,0 +1,95 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/bamgoo/base"
+)
+
+func TestCacheCredentialsAndRequestId(t *testing.T) {
+	calls := 0
+	m, _ := openTestModule(t, Map{"web": Map{"requestid": "X-Request-Id"}}, map[string]Router{
+		"page": {Uri: "/page", Method: GET, Setting: Map{"cache": "1m"}, Action: func(ctx *Context) {
+			calls++
+			ctx.Text("page")
+		}},
+		"private": {Uri: "/private", Method: GET, Setting: Map{"cache": "1m"}, Action: func(ctx *Context) {
+			calls++
+			ctx.Header("Cache-Control", "private")
+			ctx.Text("private")
+		}},
+	})
+	serve := func(target, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(GET, target, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		res := httptest.NewRecorder()
+		m.Serve("default."+target[1:]+".*", Map{}, res, req)
+		return res
+	}
+
+	first := serve("/page", "")
+	hit := serve("/page", "")
+	if calls != 1 || hit.Body.String() != "page" {
+		t.Fatalf("action ran %d times, want a cache hit", calls)
+	}
+	if id := hit.Header().Get("X-Request-Id"); id == "" || id == first.Header().Get("X-Request-Id") {
+		t.Errorf("hit request id %q replays the first one", id)
+	}
+
+	if res := serve("/page", "Bearer user-b"); res.Code != http.StatusOK || calls != 2 {
+		t.Errorf("credentialed request: action ran %d times, want a miss", calls)
+	}
+
+	serve("/private", "")
+	serve("/private", "")
+	if calls != 4 {
+		t.Errorf("private response was cached, action ran %d times", calls)
+	}
+}
+
+func TestStaticFileETag(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log(1)"), 0644)
+	m, _ := openTestModule(t, Map{"web": Map{"static": dir}}, map[string]Router{
+		"file": {Uri: "/file", Method: GET, Action: func(ctx *Context) { ctx.File(filepath.Join(dir, "app.js")) }},
+	})
+
+	res := httptest.NewRecorder()
+	m.Serve("", Map{}, res, httptest.NewRequest(GET, "/app.js", nil))
+	etag := res.Header().Get("ETag")
+	if res.Code != http.StatusOK || etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("static file: %d etag %q", res.Code, etag)
+	}
+
+	res = httptest.NewRecorder()
+	m.Serve("default.file.*", Map{}, res, httptest.NewRequest(GET, "/file", nil))
+	if etag := res.Header().Get("ETag"); etag != "" {
+		t.Errorf("ctx.File hashed an etag %s", etag)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := fileETagOf(filepath.Join(dir, "app.js")); got != etag {
+				t.Errorf("concurrent etag %q, want %q", got, etag)
+			}
+		}()
+	}
+	wg.Wait()
+
+	large := filepath.Join(dir, "large.bin")
+	os.WriteFile(large, make([]byte, fileETagMaxSize+1), 0644)
+	if etag := fileETagOf(large); !strings.HasPrefix(etag, `W/"`) {
+		t.Errorf("large file etag %q, want a weak one", etag)
+	}
+}
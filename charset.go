@@ -0,0 +1,83 @@
+package web
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/bamgoo/base"
+	"golang.org/x/net/html/charset"
+)
+
+// uploadCharset reads Setting["uploadCharset"]: true detects the charset
+// of uploaded text files, a charset name also detects and is the fallback
+// for non UTF-8 content without BOM or declared charset.
+func uploadCharset(setting Map) (bool, string) {
+	if setting == nil {
+		return false, ""
+	}
+	switch vv := setting["uploadCharset"].(type) {
+	case bool:
+		return vv, ""
+	case string:
+		return vv != "", strings.ToLower(vv)
+	}
+	return false, ""
+}
+
+// uploadTranscode reads Setting["uploadTranscode"], saving detected
+// non UTF-8 text files as UTF-8.
+func uploadTranscode(setting Map) bool {
+	if setting == nil {
+		return false
+	}
+	vv, _ := setting["uploadTranscode"].(bool)
+	return vv
+}
+
+// isTextUpload reports if an upload is a text file worth detecting.
+func isTextUpload(mimeType, ext string) bool {
+	if strings.HasPrefix(strings.ToLower(mimeType), "text/") {
+		return true
+	}
+	switch strings.ToLower(ext) {
+	case "txt", "csv", "tsv", "log", "md", "srt", "ini":
+		return true
+	}
+	return false
+}
+
+// detectCharset detects the charset of the head of a text file, by BOM,
+// the declared charset, UTF-8 validity, then the fallback.
+func detectCharset(head []byte, contentType, fallback string) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8"
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if name := strings.ToLower(params["charset"]); name != "" {
+			return name
+		}
+	}
+
+	// The head may end in the middle of a rune.
+	valid := head
+	for i := 0; i < utf8.UTFMax && len(valid) > 0 && !utf8.Valid(valid); i++ {
+		valid = valid[:len(valid)-1]
+	}
+	if utf8.Valid(valid) && len(head)-len(valid) < utf8.UTFMax {
+		return "utf-8"
+	}
+
+	if fallback != "" {
+		return fallback
+	}
+	_, name, _ := charset.DetermineEncoding(head, "text/plain")
+	return name
+}
@@ -1,9 +1,15 @@
 package web
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"runtime"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/bamgoo/bamgoo"
 	. "github.com/bamgoo/base"
@@ -24,6 +30,9 @@ type (
 		Data     Vars     `json:"data"`
 		Setting  Map      `json:"-"`
 
+		// Alias maps an arg key to the request field it reads from.
+		Alias map[string]string `json:"alias"`
+
 		Routing Routing   `json:"routing"`
 		Actions []ctxFunc `json:"-"`
 		Action  ctxFunc   `json:"-"`
@@ -31,6 +40,11 @@ type (
 		Sign bool `json:"sign"`
 		Auth bool `json:"auth"`
 
+		// Priority orders registration of overlapping uris, higher first.
+		Priority int `json:"priority"`
+		// Timeout limits the action, overriding Config.HandlerTimeout.
+		Timeout time.Duration `json:"timeout"`
+
 		Found  ctxFunc `json:"-"`
 		Error  ctxFunc `json:"-"`
 		Failed ctxFunc `json:"-"`
@@ -39,6 +53,28 @@ type (
 
 	Routing map[string]Router
 
+	// Envelope shapes the json of ctx.Echo, the default is
+	// {code, time, text, data}.
+	Envelope func(code int, text string, data Map) Any
+
+	// Serializer encodes a response body of a type, see ctx.Serialize.
+	Serializer func(value Any) ([]byte, error)
+
+	// CBOR encodes and decodes application/cbor bodies with a library of
+	// choice, see ctx.CBOR. Without one cbor bodies are left unparsed.
+	CBOR interface {
+		Marshal(value Any) ([]byte, error)
+		Unmarshal(data []byte, value Any) error
+	}
+
+	// UploadSink consumes an uploaded file stream and returns a reference,
+	// routers use it by Setting["uploadSink"] with its registered name.
+	UploadSink func(field, filename, mime string, reader io.Reader) (string, error)
+
+	// UploadRollback removes what a sink stored when the request fails
+	// afterwards, it is registered with the name of its sink.
+	UploadRollback func(field, ref string)
+
 	// Filter defines HTTP filter/interceptor.
 	Filter struct {
 		Name     string  `json:"name"`
@@ -47,6 +83,17 @@ type (
 		Request  ctxFunc `json:"-"`
 		Execute  ctxFunc `json:"-"`
 		Response ctxFunc `json:"-"`
+		// Begin runs right before the action, Finish after the response is
+		// written with the final ctx.Code, only if Begin ran. Neither calls
+		// ctx.Next, they pair up for things like transactions in ctx.Locals.
+		Begin  ctxFunc `json:"-"`
+		Finish ctxFunc `json:"-"`
+		// Phase moves Request from the request filters to a pipeline
+		// position, like PhasePreAuth.
+		Phase string `json:"phase"`
+		// Match limits the filter to routes whose name or path matches one
+		// of the globs, a trailing * matches any suffix, empty runs always.
+		Match []string `json:"match"`
 	}
 
 	// Handler defines HTTP handler for errors.
@@ -67,6 +114,8 @@ type (
 		Mimetype  string `json:"mimetype"`
 		Length    int64  `json:"length"`
 		Tempfile  string `json:"tempfile"`
+		// Charset of text uploads, see Setting["uploadCharset"].
+		Charset string `json:"charset"`
 	}
 )
 
@@ -80,10 +129,31 @@ func (m *Module) RegisterRouter(name string, config Router) {
 	}
 
 	name = strings.ToLower(name)
+	source := callerSource()
 	if bamgoo.Override() {
 		m.routers[name] = config
+		m.routerSources[name] = source
 	} else if _, ok := m.routers[name]; !ok {
 		m.routers[name] = config
+		m.routerSources[name] = source
+	} else {
+		m.duplicates = append(m.duplicates, fmt.Sprintf("%s registered at %s, duplicate at %s ignored", name, m.routerSources[name], source))
+	}
+}
+
+// callerSource returns the file:line registering outside bamgoo packages.
+func callerSource() string {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "github.com/bamgoo/") {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
+		if !more {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
 	}
 }
 
@@ -97,6 +167,13 @@ func (m *Module) RegisterFilter(name string, config Filter) {
 	}
 
 	name = strings.ToLower(name)
+	config.Phase = strings.ToLower(config.Phase)
+	switch config.Phase {
+	case "", PhasePreParse, PhasePreAuth, PhasePreExecute:
+	default:
+		panic("Invalid web filter phase: " + config.Phase)
+	}
+
 	if bamgoo.Override() {
 		m.filters[name] = config
 	} else if _, ok := m.filters[name]; !ok {
@@ -121,11 +198,324 @@ func (m *Module) RegisterHandler(name string, config Handler) {
 	}
 }
 
+// RemoveRoute removes a router at runtime, name may carry a site prefix.
+func (m *Module) RemoveRoute(name string) error {
+	m.mutex.Lock()
+
+	siteName, routerName := splitPrefix(name)
+	if routerName == "" {
+		m.mutex.Unlock()
+		return errors.New("invalid web router: " + name)
+	}
+	if !m.opened {
+		m.mutex.Unlock()
+		return errors.New("web not opened, can't remove router: " + name)
+	}
+
+	sites := []*Site{}
+	if siteName == "*" {
+		for _, site := range m.sites {
+			sites = append(sites, site)
+		}
+	} else if site, ok := m.sites[siteName]; ok {
+		sites = append(sites, site)
+	}
+
+	// Rebuild on copies, in-flight requests keep the old sites, and
+	// nothing changes until the router is known.
+	keys := routerKeys(routerName)
+	rebuilt := []*Site{}
+	for _, old := range sites {
+		site := &Site{}
+		*site = *old
+		site.routers = make(map[string]Router, len(old.routers))
+		for key, router := range old.routers {
+			if _, ok := keys[key]; !ok {
+				site.routers[key] = router
+			}
+		}
+		if len(site.routers) < len(old.routers) {
+			rebuilt = append(rebuilt, site)
+		}
+	}
+	if len(rebuilt) == 0 {
+		m.mutex.Unlock()
+		return errors.New("unknown web router: " + name)
+	}
+
+	for key := range m.routers {
+		keySite, keyRouter := splitPrefix(key)
+		if keyRouter == routerName && (siteName == "*" || keySite == siteName) {
+			delete(m.routers, key)
+		}
+	}
+
+	removed := []string{}
+	for _, site := range rebuilt {
+		old := m.sites[site.Name]
+		m.buildSite(site)
+		m.sites[site.Name] = site
+		for key := range old.routerInfos {
+			if _, ok := site.routerInfos[key]; !ok {
+				removed = append(removed, site.Name+"."+key)
+			}
+		}
+	}
+
+	var connect Connection
+	if m.instance != nil {
+		connect = m.instance.connect
+	}
+	m.mutex.Unlock()
+
+	if connect != nil {
+		return unregisterRoutes(connect, removed)
+	}
+	return nil
+}
+
+// unregisterRoutes removes the routes from the connection, it is called
+// without the module lock as Unregister waits for in-flight requests,
+// which may need the module.
+func unregisterRoutes(connect Connection, names []string) error {
+	for _, name := range names {
+		if err := connect.Unregister(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routerKeys are the site router keys a router expands to, one for
+// Action and any method, and one per Routing method.
+func routerKeys(routerName string) map[string]struct{} {
+	keys := map[string]struct{}{routerName + ".*": {}}
+	for _, method := range []string{GET, POST, PUT, DELETE, PATCH, OPTIONS, HEAD} {
+		keys[routerName+"."+strings.ToLower(method)] = struct{}{}
+	}
+	return keys
+}
+
+// Routes lists route infos of all sites, sorted by site, router and uri.
+func (m *Module) Routes() []Info {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	infos := []Info{}
+	for _, site := range m.sites {
+		infos = append(infos, site.Routes()...)
+	}
+	sortInfos(infos)
+	return infos
+}
+
+// Routes lists route infos of the site, sorted by router and uri.
+func (site *Site) Routes() []Info {
+	infos := make([]Info, 0, len(site.routerInfos))
+	for _, info := range site.routerInfos {
+		infos = append(infos, info)
+	}
+	sortInfos(infos)
+	return infos
+}
+
+// Routes lists all registered routes.
+func Routes() []Info {
+	return module.Routes()
+}
+
+func sortInfos(infos []Info) {
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Site != infos[j].Site {
+			return infos[i].Site < infos[j].Site
+		}
+		if infos[i].Router != infos[j].Router {
+			return infos[i].Router < infos[j].Router
+		}
+		return infos[i].Uri < infos[j].Uri
+	})
+}
+
+// RegisterUploadSink registers a named upload sink.
+func (m *Module) RegisterUploadSink(name string, sink UploadSink) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if sink == nil {
+		panic("Invalid web upload sink: " + name)
+	}
+
+	name = strings.ToLower(name)
+	if bamgoo.Override() {
+		m.sinks[name] = sink
+	} else if _, ok := m.sinks[name]; !ok {
+		m.sinks[name] = sink
+	}
+}
+
+// RegisterUploadRollback registers the rollback of a named upload sink.
+func (m *Module) RegisterUploadRollback(name string, rollback UploadRollback) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if rollback == nil {
+		panic("Invalid web upload rollback: " + name)
+	}
+
+	name = strings.ToLower(name)
+	if bamgoo.Override() {
+		m.rollbacks[name] = rollback
+	} else if _, ok := m.rollbacks[name]; !ok {
+		m.rollbacks[name] = rollback
+	}
+}
+
+// RegisterSerializer registers a serializer for the type name like csv.
+func (m *Module) RegisterSerializer(name string, serializer Serializer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if serializer == nil {
+		panic("Invalid web serializer: " + name)
+	}
+
+	name = strings.ToLower(name)
+	if bamgoo.Override() {
+		m.serializers[name] = serializer
+	} else if _, ok := m.serializers[name]; !ok {
+		m.serializers[name] = serializer
+	}
+}
+
+func (m *Module) serializer(name string) Serializer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.serializers[strings.ToLower(name)]
+}
+
+// RegisterEnvelope registers the echo envelope, the name is unused.
+func (m *Module) RegisterEnvelope(name string, envelope Envelope) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if envelope == nil {
+		panic("Invalid web envelope: " + name)
+	}
+	if bamgoo.Override() || m.envelope == nil {
+		m.envelope = envelope
+	}
+}
+
+// RegisterCBOR registers the cbor codec, the name is unused.
+func (m *Module) RegisterCBOR(name string, codec CBOR) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if codec == nil {
+		panic("Invalid web cbor: " + name)
+	}
+	if bamgoo.Override() || m.cbor == nil {
+		m.cbor = codec
+	}
+}
+
+func (m *Module) uploadSink(setting Map) UploadSink {
+	if setting == nil {
+		return nil
+	}
+	val, ok := setting["uploadSink"]
+	if !ok {
+		val = setting["uploadsink"]
+	}
+	switch v := val.(type) {
+	case UploadSink:
+		return v
+	case func(string, string, string, io.Reader) (string, error):
+		return v
+	case string:
+		m.mutex.RLock()
+		defer m.mutex.RUnlock()
+		return m.sinks[strings.ToLower(v)]
+	}
+	return nil
+}
+
+// uploadRollback is Setting["uploadRollback"], or the rollback registered
+// with the name of the upload sink.
+func (m *Module) uploadRollback(setting Map) UploadRollback {
+	if setting == nil {
+		return nil
+	}
+	val, ok := setting["uploadRollback"]
+	if !ok {
+		val, ok = setting["uploadrollback"]
+	}
+	if !ok {
+		if val, ok = setting["uploadSink"]; !ok {
+			val = setting["uploadsink"]
+		}
+	}
+	switch v := val.(type) {
+	case UploadRollback:
+		return v
+	case func(string, string):
+		return v
+	case string:
+		m.mutex.RLock()
+		defer m.mutex.RUnlock()
+		return m.rollbacks[strings.ToLower(v)]
+	}
+	return nil
+}
+
 func applyRouter(site *Site, routerName string, config Router) {
+	checkRouter(routerName, config, site.Config.StrictRouting)
 	routers := expandRouter(routerName, config)
 	storeRouters(site.routers, routers)
 }
 
+// checkRouter warns when Action and Routing overlap, or panics if strict.
+// Methods in Routing always take precedence, the Action registers a
+// catch-all that only serves the methods Routing doesn't define.
+func checkRouter(routerName string, config Router, strict bool) {
+	if config.Action == nil || len(config.Routing) == 0 {
+		return
+	}
+
+	// An action without method serves every method, so it overlaps
+	// each routing method, which takes precedence over it.
+	action, _ := normalizeMethod(config.Method)
+	keys := make([]string, 0, len(config.Routing))
+	for key := range config.Routing {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	problem := ""
+	for _, key := range keys {
+		method, _ := normalizeMethod(key)
+		if method == "" {
+			problem = "wildcard routing is shadowed by action"
+			break
+		}
+		if action == "" {
+			problem = "routing " + method + " shadows the action for any method"
+			break
+		}
+		if method == action {
+			problem = "action method " + method + " is shadowed by routing"
+			break
+		}
+	}
+	if problem == "" {
+		return
+	}
+	if strict {
+		panic("Invalid web router: " + routerName + " " + problem)
+	}
+	log.Printf("web router %s: %s", routerName, problem)
+}
+
 func expandRouter(routerName string, config Router) map[string]Router {
 	if config.Uris == nil || len(config.Uris) == 0 {
 		config.Uris = []string{config.Uri}
@@ -133,11 +523,27 @@ func expandRouter(routerName string, config Router) map[string]Router {
 		config.Uris = append(config.Uris, config.Uri)
 	}
 
+	if config.Method != "" {
+		method, ok := normalizeMethod(config.Method)
+		if !ok {
+			panic("Invalid web router method: " + routerName + " " + config.Method)
+		}
+		config.Method = method
+	}
+
 	routers := make(map[string]Router)
 
 	if config.Routing != nil {
-		for method, methodConfig := range config.Routing {
-			realName := fmt.Sprintf("%s.%s", routerName, method)
+		for key, methodConfig := range config.Routing {
+			method, ok := normalizeMethod(key)
+			if !ok {
+				panic("Invalid web router method: " + routerName + " " + key)
+			}
+
+			realName := fmt.Sprintf("%s.%s", routerName, strings.ToLower(key))
+			if method == "" {
+				realName = routerName + ".*"
+			}
 			realConfig := config
 
 			realConfig.Method = method
@@ -146,6 +552,7 @@ func expandRouter(routerName string, config Router) map[string]Router {
 			realConfig.Actions = nil
 			realConfig.Routing = nil
 			realConfig.Args = nil
+			realConfig.Alias = nil
 			realConfig.Data = nil
 			realConfig.Setting = nil
 
@@ -155,6 +562,12 @@ func expandRouter(routerName string, config Router) map[string]Router {
 					realConfig.Args[k] = v
 				}
 			}
+			if config.Alias != nil {
+				realConfig.Alias = map[string]string{}
+				for k, v := range config.Alias {
+					realConfig.Alias[k] = v
+				}
+			}
 			if config.Data != nil {
 				realConfig.Data = Vars{}
 				for k, v := range config.Data {
@@ -174,6 +587,9 @@ func expandRouter(routerName string, config Router) map[string]Router {
 			if methodConfig.Desc != "" {
 				realConfig.Desc = methodConfig.Desc
 			}
+			if methodConfig.Priority != 0 {
+				realConfig.Priority = methodConfig.Priority
+			}
 			if methodConfig.Args != nil {
 				if realConfig.Args == nil {
 					realConfig.Args = Vars{}
@@ -182,6 +598,14 @@ func expandRouter(routerName string, config Router) map[string]Router {
 					realConfig.Args[k] = v
 				}
 			}
+			if methodConfig.Alias != nil {
+				if realConfig.Alias == nil {
+					realConfig.Alias = map[string]string{}
+				}
+				for k, v := range methodConfig.Alias {
+					realConfig.Alias[k] = v
+				}
+			}
 			if methodConfig.Data != nil {
 				if realConfig.Data == nil {
 					realConfig.Data = Vars{}
@@ -231,6 +655,18 @@ func expandRouter(routerName string, config Router) map[string]Router {
 	return routers
 }
 
+// normalizeMethod upper-cases a method, "*" and "any" mean all methods.
+func normalizeMethod(method string) (string, bool) {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	switch method {
+	case "*", "ANY":
+		return "", true
+	case GET, POST, PUT, DELETE, PATCH, OPTIONS, HEAD:
+		return method, true
+	}
+	return method, false
+}
+
 func storeRouters(target map[string]Router, routers map[string]Router) {
 	for key, router := range routers {
 		key = strings.ToLower(key)
@@ -0,0 +1,269 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/bamgoo/base"
+)
+
+func serveTest(handler http.Handler, method, target string) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(method, target, nil))
+	return res
+}
+
+func TestRemoveRoute(t *testing.T) {
+	text := func(body string) ctxFunc {
+		return func(ctx *Context) { ctx.Text(body) }
+	}
+	m, handler := openDefaultModule(t, Map{}, map[string]Router{
+		"ping":              {Uri: "/ping", Method: GET, Action: text("pong")},
+		"default.ping.info": {Uri: "/ping/info", Method: GET, Action: text("info")},
+	})
+
+	if res := serveTest(handler, GET, "/ping"); res.Code != http.StatusOK {
+		t.Fatalf("before: status = %d, want 200", res.Code)
+	}
+	if err := m.RemoveRoute("ping"); err != nil {
+		t.Fatal(err)
+	}
+	if res := serveTest(handler, GET, "/ping"); res.Code != http.StatusNotFound {
+		t.Errorf("after: status = %d, want 404", res.Code)
+	}
+	if res := serveTest(handler, GET, "/ping/info"); res.Code != http.StatusOK || res.Body.String() != "info" {
+		t.Errorf("sibling: status = %d body = %q, want 200 info", res.Code, res.Body.String())
+	}
+}
+
+func TestRemoveRouteUnknown(t *testing.T) {
+	m, connect := openTestModule(t, Map{}, map[string]Router{
+		"ping": {Uri: "/ping", Method: GET, Action: func(ctx *Context) {}},
+	})
+	site := m.sites["default"]
+
+	if err := m.RemoveRoute("pong"); err == nil {
+		t.Fatal("removing an unknown router should fail")
+	}
+	if m.sites["default"] != site || len(m.routers) != 1 || len(connect.names()) != 1 {
+		t.Error("removing an unknown router changed the module")
+	}
+
+	if err := newTestModule().RemoveRoute("ping"); err == nil {
+		t.Error("removing from an unopened module should fail")
+	}
+}
+
+func TestRemoveRouteWhileServing(t *testing.T) {
+	routers := map[string]Router{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		routers[name] = Router{Uri: "/" + name, Method: GET, Action: func(ctx *Context) { ctx.Text("ok") }}
+	}
+	routers["keep"] = Router{Uri: "/keep", Method: GET, Action: func(ctx *Context) { ctx.Text("ok") }}
+	m, handler := openDefaultModule(t, Map{}, routers)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if res := serveTest(handler, GET, "/keep"); res.Code != http.StatusOK {
+					t.Errorf("status = %d, want 200", res.Code)
+					return
+				}
+				serveTest(handler, GET, "/a")
+			}
+		}()
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := m.RemoveRoute(name); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestCheckRouterAnyMethodAction(t *testing.T) {
+	router := Router{
+		Uri:     "/users",
+		Action:  func(ctx *Context) {},
+		Routing: Routing{"get": {Action: func(ctx *Context) {}}},
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("strict routing should reject GET routing overlapping an any-method action")
+		}
+	}()
+	checkRouter("users", router, true)
+}
+
+func TestUnmatchedStaticSite(t *testing.T) {
+	_, handler := openDefaultModule(t, Map{
+		"web":  Map{"domain": "example.com", "unmatched": "unknown host"},
+		"site": Map{"static": Map{"domain": "static.example.com"}},
+	}, map[string]Router{
+		"ping": {Uri: "/ping", Method: GET, Action: func(ctx *Context) { ctx.Text("pong") }},
+	})
+
+	if res := serveTest(handler, GET, "http://other.org/ping"); res.Code != http.StatusNotFound || res.Body.String() != "unknown host" {
+		t.Errorf("unknown host: %d %q, want the unmatched 404", res.Code, res.Body.String())
+	}
+	if res := serveTest(handler, GET, "http://static.example.com/missing"); res.Body.String() == "unknown host" {
+		t.Error("a site without routes got the unmatched answer")
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	_, handler := openDefaultModule(t, Map{"web": Map{"autooptions": true}}, map[string]Router{
+		"submit": {Uri: "/submit", Method: POST, Action: func(ctx *Context) { ctx.Text("ok") }},
+	})
+
+	res := serveTest(handler, GET, "/submit")
+	if res.Code != http.StatusMethodNotAllowed || res.Header().Get("Allow") != "POST" {
+		t.Errorf("GET /submit: %d Allow %q, want 405 Allow POST", res.Code, res.Header().Get("Allow"))
+	}
+	res = serveTest(handler, OPTIONS, "/submit")
+	if res.Code != http.StatusNoContent || res.Header().Get("Allow") != "POST, OPTIONS" {
+		t.Errorf("OPTIONS /submit: %d Allow %q, want 204 Allow POST, OPTIONS", res.Code, res.Header().Get("Allow"))
+	}
+	if res := serveTest(handler, GET, "/missing"); res.Code != http.StatusNotFound {
+		t.Errorf("GET /missing: %d, want 404", res.Code)
+	}
+}
+
+func TestFoundReason(t *testing.T) {
+	cases := []struct {
+		name   string
+		config Map
+		want   string
+	}{
+		{"route", Map{}, FoundRoute},
+		{"static", Map{"static": t.TempDir()}, FoundStatic},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reason := ""
+			m := newTestModule()
+			m.RegisterDriver("test", &testDriver{&testConnect{routes: map[string]Info{}}})
+			m.RegisterHandler("found", Handler{Found: func(ctx *Context) {
+				reason = ctx.FoundReason()
+				ctx.Text("not found")
+			}})
+			m.Config(Map{"web": c.config})
+			m.Setup()
+			m.Open()
+
+			res := httptest.NewRecorder()
+			m.Serve("", Map{}, res, httptest.NewRequest(GET, "/missing.txt", nil))
+			if reason != c.want {
+				t.Errorf("reason = %q, want %q", reason, c.want)
+			}
+		})
+	}
+}
+
+func TestRegisterFilterPhase(t *testing.T) {
+	m := newTestModule()
+	m.RegisterFilter("auth", Filter{Phase: "PreAuth", Request: func(ctx *Context) { ctx.Next() }})
+	if phase := m.filters["auth"].Phase; phase != PhasePreAuth {
+		t.Errorf("phase = %q, want %q", phase, PhasePreAuth)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("an unknown phase was registered")
+		}
+	}()
+	m.RegisterFilter("late", Filter{Phase: "postexecute", Request: func(ctx *Context) { ctx.Next() }})
+}
+
+func TestDocsThroughPipeline(t *testing.T) {
+	m := newTestModule()
+	m.RegisterDriver("test", &defaultDriver{})
+	m.RegisterRouter("ping", Router{Uri: "/ping", Method: GET, Action: func(ctx *Context) { ctx.Text("pong") }})
+	m.RegisterFilter("key", Filter{Request: func(ctx *Context) {
+		if ctx.Header("X-Key") != "secret" {
+			ctx.Status(StatusForbidden)
+			return
+		}
+		ctx.Next()
+	}})
+	m.Config(Map{"web": Map{"docs": "/docs"}})
+	m.Setup()
+	m.Open()
+	handler := http.HandlerFunc(m.instance.connect.(*defaultConnect).dispatch)
+
+	if res := serveTest(handler, GET, "/docs"); res.Code != http.StatusForbidden {
+		t.Errorf("docs without key: %d, want 403", res.Code)
+	}
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(GET, target, nil)
+		req.Header.Set("X-Key", "secret")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+	if res := serve("/docs"); res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "/docs/openapi.json") {
+		t.Errorf("docs page: %d", res.Code)
+	}
+	res := serve("/docs/openapi.json")
+	spec := res.Body.String()
+	if res.Code != http.StatusOK || !strings.Contains(spec, `"/ping"`) || strings.Contains(spec, `"/docs`) {
+		t.Errorf("spec: %d %s", res.Code, spec)
+	}
+}
+
+func TestOpenAPIPerSite(t *testing.T) {
+	action := func(ctx *Context) { ctx.Text("ok") }
+	m, _ := openTestModule(t, Map{
+		"site": Map{"blog": Map{"domain": "blog.example.com"}},
+	}, map[string]Router{
+		"*.ping":    {Uri: "/ping", Method: GET, Desc: "ping", Action: action},
+		"blog.send": {Uri: "/ping", Method: POST, Desc: "blog ping", Action: action},
+		"echo":      {Uri: "/echo", Args: Vars{"text": Var{Type: "string"}}, Action: action},
+	})
+
+	spec := func(name string) Map {
+		t.Helper()
+		data, err := m.OpenAPI(name)
+		if err != nil {
+			t.Fatalf("openapi %s: %v", name, err)
+		}
+		doc := Map{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc["paths"].(map[string]any)
+	}
+
+	blog := spec("blog")["/ping"].(map[string]any)
+	if _, ok := blog["post"]; !ok {
+		t.Errorf("blog ping misses post: %v", blog)
+	}
+	paths := spec("")
+	if ping := paths["/ping"].(map[string]any); ping["post"] != nil || ping["get"] == nil {
+		t.Errorf("default ping: %v", ping)
+	}
+	echo := paths["/echo"].(map[string]any)
+	for _, method := range openapiAnyMethods {
+		if echo[method] == nil {
+			t.Errorf("any-method echo misses %s", method)
+		}
+	}
+	if _, err := m.OpenAPI("missing"); err == nil {
+		t.Error("unknown site should fail")
+	}
+}
@@ -15,6 +15,31 @@ const (
 	DEFAULT = "default"
 )
 
+const (
+	// FoundRoute means no route matched the request, and the site has no
+	// static root to look up.
+	FoundRoute = "route"
+	// FoundStatic means neither a route nor a static file matched.
+	FoundStatic = "static"
+	// FoundAction means the action called ctx.Found.
+	FoundAction = "action"
+)
+
+const (
+	// PhasePreParse runs a filter Request before body parsing.
+	PhasePreParse = "preparse"
+	// PhasePreAuth runs a filter Request before authorizing.
+	PhasePreAuth = "preauth"
+	// PhasePreExecute runs a filter Request right before execute.
+	PhasePreExecute = "preexecute"
+)
+
+const (
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceDesktop = "desktop"
+)
+
 const (
 	StatusContinue           = http.StatusContinue
 	StatusSwitchingProtocols = http.StatusSwitchingProtocols
@@ -1,12 +1,21 @@
 package web
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/bamgoo/bamgoo"
 	. "github.com/bamgoo/base"
@@ -19,8 +28,20 @@ type (
 
 		uploadfiles []string
 
+		cacheKey string
+		cacheTTL time.Duration
+
+		modified time.Time
+		timings  []string
+		trailers [][2]string
+		preloads []string
+
 		index int
 		nexts []ctxFunc
+		begun bool
+
+		timedOut atomic.Bool
+		cancel   context.CancelFunc
 
 		reader *http.Request
 		writer http.ResponseWriter
@@ -29,9 +50,14 @@ type (
 		Config  Router
 		Setting Map
 
-		charset string
-		headers map[string]string
-		cookies map[string]http.Cookie
+		route string
+		trace *Trace
+
+		charset     string
+		bodyCharset string
+		headed      bool
+		headers     map[string]string
+		cookies     []http.Cookie
 
 		Method string
 		Host   string
@@ -45,16 +71,68 @@ type (
 		Form   Map
 		Upload Map
 
-		Value  Map
-		Args   Map
+		Value Map
+		Args  Map
+		// Locals is a loose value map, prefer Store and Load with
+		// unexported key types to avoid collisions between packages.
 		Locals Map
 
+		values map[any]any
+
+		rawBody []byte
+
+		foundReason string
+		result      Res
+		panicked    string
+		// rejected is the status of ctx.Reject, answered by failedDefault.
+		rejected int
+
 		Code int
 		Type string
 		Data Map
 		Body Any
 
 		Url webUrl
+
+		Timing Timing
+	}
+
+	// Timing records request stage timestamps.
+	Timing struct {
+		Start   time.Time
+		Serve   time.Time
+		Parse   time.Time
+		Execute time.Time
+	}
+
+	// FileOptions controls how ServeFile sends a file.
+	FileOptions struct {
+		// Type overrides the mime type, same as ctx.Type.
+		Type string
+		// Name is the download filename, defaults to the file base name.
+		Name string
+		// Inline sends the file as inline instead of attachment.
+		Inline bool
+		// MaxAge sets Cache-Control max-age, zero means no cache header.
+		MaxAge time.Duration
+		// NoRange disables range requests.
+		NoRange bool
+	}
+
+	// SendOptions controls how Send streams a reader.
+	SendOptions struct {
+		// Type is the mime type, same as ctx.Type.
+		Type string
+		// Name is the download filename, none means no Content-Disposition.
+		Name string
+		// Inline sends as inline instead of attachment.
+		Inline bool
+		// Size is the total size if known, sent as Content-Length.
+		Size int64
+		// Range serves range requests, the reader must be an io.ReadSeeker.
+		Range bool
+		// ModTime is the Last-Modified time for conditional requests.
+		ModTime time.Time
 	}
 
 	ctxFunc func(*Context)
@@ -81,8 +159,23 @@ func (ctx *Context) Next() {
 	}
 }
 
+// Result sets the result if given, and returns the current result,
+// error handlers use it to read the failing result.
+func (ctx *Context) Result(res ...Res) Res {
+	if len(res) > 0 {
+		ctx.result = res[0]
+		ctx.Meta.Result(res[0])
+	}
+	return ctx.result
+}
+
 func (ctx *Context) Found() {
-	ctx.site.found(ctx)
+	ctx.site.found(ctx, FoundAction)
+}
+
+// FoundReason tells why the request was not found, see FoundRoute.
+func (ctx *Context) FoundReason() string {
+	return ctx.foundReason
 }
 
 func (ctx *Context) Error(res Res) {
@@ -100,6 +193,19 @@ func (ctx *Context) Denied(res Res) {
 	ctx.site.denied(ctx)
 }
 
+// Reject fails the request from a filter with a status code, the error
+// detail goes into ctx.Data["error"]. Filters return after calling it.
+func (ctx *Context) Reject(code int, err error) {
+	if code > 0 {
+		ctx.Code = code
+		ctx.rejected = code
+	}
+	if err != nil {
+		ctx.Data["error"] = err.Error()
+	}
+	ctx.Failed(bamgoo.Invalid)
+}
+
 func (ctx *Context) Charset(charsets ...string) string {
 	if len(charsets) > 0 && charsets[0] != "" {
 		ctx.charset = charsets[0]
@@ -110,6 +216,37 @@ func (ctx *Context) Charset(charsets ...string) string {
 	return ctx.charset
 }
 
+// responseCharset is the charset of the response, a charset passed to
+// Text, Html or Json overrides the context charset.
+func (ctx *Context) responseCharset() string {
+	if ctx.bodyCharset != "" {
+		return ctx.bodyCharset
+	}
+	return ctx.Charset()
+}
+
+var knownCharsets = []string{
+	"utf-8", "utf8", "utf-16", "utf-16le", "utf-16be", "us-ascii", "ascii",
+	"gbk", "gb2312", "gb18030", "big5", "shift_jis", "euc-jp", "euc-kr",
+	"iso-2022-jp", "koi8-r", "koi8-u",
+}
+
+func parseCharset(val string) (string, bool) {
+	lower := strings.ToLower(strings.TrimSpace(val))
+	if name, ok := strings.CutPrefix(lower, "charset="); ok && name != "" {
+		return name, true
+	}
+	if strings.HasPrefix(lower, "iso-8859-") || strings.HasPrefix(lower, "windows-125") {
+		return lower, true
+	}
+	for _, name := range knownCharsets {
+		if lower == name {
+			return lower, true
+		}
+	}
+	return "", false
+}
+
 func (ctx *Context) Header(key string, vals ...string) string {
 	if len(vals) > 0 {
 		ctx.headers[key] = vals[0]
@@ -118,24 +255,188 @@ func (ctx *Context) Header(key string, vals ...string) string {
 	return ctx.reader.Header.Get(key)
 }
 
+// Param returns a path param only, unlike Value it can't be shadowed
+// by query or form fields.
+func (ctx *Context) Param(key string) string {
+	if val, ok := ctx.Params[key]; ok {
+		if vv, ok := paramValue(val).(string); ok {
+			return vv
+		}
+	}
+	return ""
+}
+
+// RequestBody returns the request body stream, it is unread only on
+// routes with Setting["rawBody"] set.
+func (ctx *Context) RequestBody() io.ReadCloser {
+	return ctx.reader.Body
+}
+
+// DeviceType classifies the User-Agent as mobile, tablet or desktop with
+// simple heuristics.
+func (ctx *Context) DeviceType() string {
+	ua := strings.ToLower(ctx.Agent())
+	switch {
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"),
+		strings.Contains(ua, "kindle"), strings.Contains(ua, "silk"),
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return DeviceTablet
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"),
+		strings.Contains(ua, "ipod"), strings.Contains(ua, "android"),
+		strings.Contains(ua, "windows phone"), strings.Contains(ua, "blackberry"),
+		strings.Contains(ua, "opera mini"):
+		return DeviceMobile
+	}
+	return DeviceDesktop
+}
+
+// IsMobile reports a mobile User-Agent, tablets excluded.
+func (ctx *Context) IsMobile() bool {
+	return ctx.DeviceType() == DeviceMobile
+}
+
+// Preload adds a preload hint, all hints go into one Link header. The as
+// is the destination like script, style or font, fonts are crossorigin.
+func (ctx *Context) Preload(url, as string) {
+	link := "<" + url + ">; rel=preload"
+	if as != "" {
+		link += "; as=" + as
+	}
+	if as == "font" {
+		link += "; crossorigin"
+	}
+	ctx.preloads = append(ctx.preloads, link)
+}
+
+// Trace returns the trace context, nil unless Config.Trace is set.
+func (ctx *Context) Trace() *Trace {
+	return ctx.trace
+}
+
+// RequestId returns the request id, empty unless Config.RequestId is set.
+func (ctx *Context) RequestId() string {
+	id, _ := ctx.Locals["requestId"].(string)
+	return id
+}
+
+// Site returns the name of the site serving the request.
+func (ctx *Context) Site() string {
+	return ctx.site.Name
+}
+
+// SiteConfig returns a copy of the serving site's config.
+func (ctx *Context) SiteConfig() Config {
+	return ctx.site.Config
+}
+
+// Route returns the matched uri pattern like /users/{id}, empty when no
+// route matched.
+func (ctx *Context) Route() string {
+	return ctx.route
+}
+
+// CSPNonce returns the per-request nonce for inline scripts and styles,
+// it is kept in ctx.Locals["cspNonce"] for templates.
+func (ctx *Context) CSPNonce() string {
+	if nonce, ok := ctx.Locals["cspNonce"].(string); ok && nonce != "" {
+		return nonce
+	}
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	nonce := base64.StdEncoding.EncodeToString(bytes)
+	ctx.Locals["cspNonce"] = nonce
+	return nonce
+}
+
+// PeekBody returns up to n bytes of the request body without consuming
+// them, so parsing or the action still reads the full body.
+func (ctx *Context) PeekBody(n int) ([]byte, error) {
+	if ctx.reader.Body == nil || ctx.reader.Body == http.NoBody {
+		return nil, nil
+	}
+	body, ok := ctx.reader.Body.(*peekBody)
+	if !ok || body.Size() < n {
+		size := n
+		if size < 4096 {
+			size = 4096
+		}
+		body = &peekBody{bufio.NewReaderSize(ctx.reader.Body, size), ctx.reader.Body}
+		ctx.reader.Body = body
+	}
+	data, err := body.Peek(n)
+	if err == io.EOF || err == bufio.ErrBufferFull {
+		err = nil
+	}
+	return data, err
+}
+
+// peekBody buffers the request body for PeekBody.
+type peekBody struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// ParamRaw returns a path param still percent-encoded, as matched with
+// Config.UseEncodedPath, otherwise it is the same as Param.
+func (ctx *Context) ParamRaw(key string) string {
+	if raws := rawParams(ctx.reader.Context()); raws != nil {
+		if val, ok := raws[key]; ok {
+			return val
+		}
+	}
+	return ctx.Param(key)
+}
+
+// Headers returns all values of a request header.
+func (ctx *Context) Headers(key string) []string {
+	return ctx.reader.Header.Values(key)
+}
+
+// HeaderMap returns a copy of all request headers.
+func (ctx *Context) HeaderMap() http.Header {
+	return ctx.reader.Header.Clone()
+}
+
+// Cookie reads or sets a cookie, cookies in Config.Protect are encoded.
+// A trailing true protects a cookie being set for this call only, read it
+// back with ProtectedCookie.
 func (ctx *Context) Cookie(key string, vals ...Any) string {
 	if len(vals) > 0 {
 		vvv := vals[0]
 		if vvv == nil {
 			cookie := http.Cookie{Name: key, HttpOnly: true, MaxAge: -1}
-			ctx.cookies[key] = cookie
+			ctx.cookies = append(ctx.cookies, cookie)
 			return ""
 		}
+		protect := ctx.site.protectedCookie(key)
+		if len(vals) > 1 {
+			if vv, ok := vals[1].(bool); ok && vv {
+				protect = true
+			}
+		}
+
+		var cookie http.Cookie
 		switch val := vvv.(type) {
 		case http.Cookie:
-			ctx.cookies[key] = val
+			cookie = val
+		case *http.Cookie:
+			cookie = *val
 		case string:
-			cookie := http.Cookie{Name: key, Value: val}
-			ctx.cookies[key] = cookie
+			cookie = http.Cookie{Name: key, Value: val}
+		default:
+			return ""
 		}
+		if protect && cookie.MaxAge >= 0 {
+			cookie.Value = ctx.site.encodeCookie(cookie.Name, cookie.Value)
+		}
+		ctx.cookies = append(ctx.cookies, cookie)
 		return ""
 	}
 
+	if ctx.site.protectedCookie(key) {
+		return ctx.ProtectedCookie(key)
+	}
+
 	c, err := ctx.reader.Cookie(key)
 	if err == nil {
 		return c.Value
@@ -143,9 +444,37 @@ func (ctx *Context) Cookie(key string, vals ...Any) string {
 	return ""
 }
 
+// ProtectedCookie reads an encoded cookie, empty if it was tampered with.
+func (ctx *Context) ProtectedCookie(key string) string {
+	c, err := ctx.reader.Cookie(key)
+	if err != nil {
+		return ""
+	}
+	if val, ok := ctx.site.decodeCookie(key, c.Value); ok {
+		return val
+	}
+	return ""
+}
+
 func (ctx *Context) IP() string {
 	ip := "127.0.0.1"
 
+	remote := ctx.reader.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if len(ctx.site.Config.Proxies) > 0 && !trustedProxy(ctx.site.Config.Proxies, remote) {
+		return remote
+	}
+	for _, header := range ctx.site.Config.RealIP {
+		if real := strings.TrimSpace(ctx.reader.Header.Get(header)); real != "" {
+			if idx := strings.Index(real, ","); idx > 0 {
+				real = strings.TrimSpace(real[:idx])
+			}
+			return real
+		}
+	}
+
 	if forwarded := ctx.reader.Header.Get("x-forwarded-for"); forwarded != "" {
 		ip = forwarded
 	} else if realIp := ctx.reader.Header.Get("X-Real-IP"); realIp != "" {
@@ -165,6 +494,128 @@ func (ctx *Context) IP() string {
 	return ip
 }
 
+// trustedProxy checks the ip against proxy ips and cidrs.
+func trustedProxy(proxies []string, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") {
+			if _, network, err := net.ParseCIDR(proxy); err == nil && network.Contains(addr) {
+				return true
+			}
+		} else if other := net.ParseIP(proxy); other != nil && other.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// abandon reports if the action timed out, 503 was answered then and
+// the response phase is skipped.
+func (ctx *Context) abandon() bool {
+	return ctx.timedOut.Load()
+}
+
+// Context returns the request context, carrying the server deadline.
+func (ctx *Context) Context() context.Context {
+	return ctx.reader.Context()
+}
+
+// Deadline returns the request deadline, if one is set.
+func (ctx *Context) Deadline() (time.Time, bool) {
+	return ctx.reader.Context().Deadline()
+}
+
+// LastModified sets the content modification time for conditional requests.
+func (ctx *Context) LastModified(t time.Time) {
+	ctx.modified = t
+	ctx.Header("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
+
+// Elapsed returns the time since the context was created.
+func (ctx *Context) Elapsed() time.Duration {
+	return time.Since(ctx.Timing.Start)
+}
+
+// ServerTiming adds an entry to the Server-Timing response header.
+func (ctx *Context) ServerTiming(name string, d time.Duration) {
+	ctx.timings = append(ctx.timings, fmt.Sprintf("%s;dur=%.3f", name, float64(d.Microseconds())/1000))
+}
+
+// Trailer sets a response trailer, declared before and sent after the body.
+func (ctx *Context) Trailer(key, value string) {
+	ctx.trailers = append(ctx.trailers, [2]string{http.CanonicalHeaderKey(key), value})
+}
+
+// Store sets a request-scoped value, use unexported key types like context.WithValue.
+func (ctx *Context) Store(key, val any) {
+	if ctx.values == nil {
+		ctx.values = make(map[any]any)
+	}
+	ctx.values[key] = val
+}
+
+// Load gets a request-scoped value set by Store.
+func (ctx *Context) Load(key any) (any, bool) {
+	val, ok := ctx.values[key]
+	return val, ok
+}
+
+// Bind decodes the request values into ptr, mapped Args take precedence over Value.
+func (ctx *Context) Bind(ptr Any) error {
+	data := ctx.Value
+	if len(ctx.Args) > 0 {
+		data = ctx.Args
+	}
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, ptr)
+}
+
+// MustBind binds like Bind, on error it fails the request and returns false.
+// Field errors are put into ctx.Data["errors"].
+func (ctx *Context) MustBind(ptr Any) bool {
+	err := ctx.Bind(ptr)
+	if err == nil {
+		return true
+	}
+
+	field := ""
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field = typeErr.Field
+	}
+	if field == "" {
+		field = "*"
+	}
+	ctx.Data["errors"] = Map{field: err.Error()}
+
+	ctx.Failed(bamgoo.Invalid)
+	return false
+}
+
+// authorization splits the Authorization header into scheme and credentials.
+func (ctx *Context) authorization() (string, string) {
+	scheme, credentials, _ := strings.Cut(strings.TrimSpace(ctx.Header("Authorization")), " ")
+	return scheme, strings.TrimSpace(credentials)
+}
+
+// AuthScheme returns the scheme of the Authorization header, like Bearer or Basic.
+func (ctx *Context) AuthScheme() string {
+	scheme, _ := ctx.authorization()
+	return scheme
+}
+
+// AuthCredentials returns the credentials of the Authorization header.
+func (ctx *Context) AuthCredentials() string {
+	_, credentials := ctx.authorization()
+	return credentials
+}
+
 func (ctx *Context) Agent() string {
 	return ctx.Header("User-Agent")
 }
@@ -175,22 +626,41 @@ func (ctx *Context) clearBody() {
 	if vv, ok := ctx.Body.(httpBufferBody); ok {
 		vv.buffer.Close()
 	}
+	if vv, ok := ctx.Body.(httpChunkedBody); ok {
+		if closer, ok := vv.reader.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	if vv, ok := ctx.Body.(httpSendBody); ok {
+		if closer, ok := vv.reader.(io.Closer); ok {
+			closer.Close()
+		}
+	}
 }
 
+// codingTyping reads the status code and type of a response. A string is
+// the charset of this response only when it is "charset=xxx" or a known
+// charset name like gbk, otherwise it is the type.
 func (ctx *Context) codingTyping(def string, args ...Any) {
 	code := 0
 	tttt := ""
+	cset := ""
 	for _, arg := range args {
 		if vv, ok := arg.(int); ok {
 			code = vv
 		}
 		if vv, ok := arg.(string); ok {
-			tttt = vv
+			if name, ok := parseCharset(vv); ok {
+				cset = name
+			} else {
+				tttt = vv
+			}
 		}
 	}
 	if code > 0 {
 		ctx.Code = code
 	}
+	ctx.bodyCharset = cset
 	if ctx.Type == "" {
 		if tttt != "" {
 			ctx.Type = tttt
@@ -252,7 +722,23 @@ func (ctx *Context) JSONP(callback string, json Any, args ...Any) {
 func (ctx *Context) File(file string, args ...string) {
 	ctx.clearBody()
 	name := ctx.fileTyping(args...)
-	ctx.Body = httpFileBody{file, name}
+	ctx.Body = httpFileBody{file: file, name: name}
+}
+
+// staticFile is ctx.File for the static files found by finding.
+func (ctx *Context) staticFile(file string) {
+	ctx.clearBody()
+	name := ctx.fileTyping()
+	ctx.Body = httpFileBody{file: file, name: name, static: true}
+}
+
+// ServeFile sends a file from disk with caching and range control.
+func (ctx *Context) ServeFile(file string, opts FileOptions) {
+	ctx.clearBody()
+	if opts.Type != "" {
+		ctx.Type = opts.Type
+	}
+	ctx.Body = httpServeFileBody{file, opts}
 }
 
 func (ctx *Context) Binary(bytes []byte, args ...string) {
@@ -267,6 +753,56 @@ func (ctx *Context) Buffer(buffer io.ReadCloser, size int64, args ...string) {
 	ctx.Body = httpBufferBody{buffer, size, name}
 }
 
+// Chunked streams a reader of unknown length with chunked encoding,
+// flushing as it goes. The reader is closed if it is an io.Closer.
+func (ctx *Context) Chunked(reader io.Reader, args ...string) {
+	ctx.clearBody()
+	name := ctx.fileTyping(args...)
+	ctx.Body = httpChunkedBody{reader, name}
+}
+
+// ReadFrom streams the reader as the body, like Chunked without a file
+// name. The reader is copied once the response is sent, so it reports
+// no bytes read yet.
+func (ctx *Context) ReadFrom(reader io.Reader) (int64, error) {
+	ctx.Chunked(reader)
+	return 0, nil
+}
+
+// Serialize sets a body encoded by the serializer registered for the
+// type, like csv or yaml.
+func (ctx *Context) Serialize(value Any, tttt string, args ...Any) {
+	ctx.clearBody()
+	ctx.Type = tttt
+	ctx.codingTyping(tttt, args...)
+	ctx.Body = httpSerializeBody{value, tttt}
+}
+
+// CBOR sets a body encoded by the registered cbor codec.
+func (ctx *Context) CBOR(value Any) {
+	ctx.clearBody()
+	ctx.Type = "cbor"
+	ctx.Body = httpCborBody{value}
+}
+
+// Send streams a reader like a decrypting one, with ranges when it can
+// seek and opts.Range is set. The reader is closed if it is an io.Closer.
+func (ctx *Context) Send(reader io.Reader, opts SendOptions) {
+	ctx.clearBody()
+	if opts.Type != "" {
+		ctx.Type = opts.Type
+	}
+	ctx.Body = httpSendBody{reader, opts}
+}
+
+// NDJSON streams values from the channel as newline delimited json, one
+// line each, flushed as they come. The producer should close the channel
+// and stop on ctx.Context().Done(), the stream ends on client disconnect.
+func (ctx *Context) NDJSON(values <-chan Any) {
+	ctx.clearBody()
+	ctx.Body = httpNdjsonBody{values}
+}
+
 func (ctx *Context) fileTyping(args ...string) string {
 	var mime, name string
 	for _, arg := range args {
@@ -292,6 +828,28 @@ func (ctx *Context) Status(code int, texts ...string) {
 	}
 }
 
+// Unavailable answers 503 with Retry-After, so clients back off, the
+// text defaults to the status text.
+func (ctx *Context) Unavailable(after time.Duration, texts ...string) {
+	text := StatusText(StatusServiceUnavailable)
+	if len(texts) > 0 && texts[0] != "" {
+		text = texts[0]
+	}
+	ctx.Header("Retry-After", retryAfter(after))
+	ctx.Status(StatusServiceUnavailable, text)
+}
+
+func retryAfter(after time.Duration) string {
+	seconds := int64(after / time.Second)
+	if after%time.Second > 0 {
+		seconds++
+	}
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
 // Echo outputs API response.
 func (ctx *Context) Echo(res Res, args ...Any) {
 	ctx.clearBody()
@@ -338,6 +896,67 @@ func (ctx *Context) Echo(res Res, args ...Any) {
 	ctx.Body = httpEchoBody{code, text, data}
 }
 
+// KeepUpload removes the uploaded files of key from the auto cleanup,
+// call it after taking ownership of the temp files, like moving them.
+func (ctx *Context) KeepUpload(key string) {
+	keeps := map[string]struct{}{}
+	for _, file := range uploadMaps(ctx.Upload[key]) {
+		if vv, ok := file["file"].(string); ok && vv != "" {
+			keeps[vv] = struct{}{}
+		}
+	}
+
+	files := make([]string, 0, len(ctx.uploadfiles))
+	for _, file := range ctx.uploadfiles {
+		if _, ok := keeps[file]; !ok {
+			files = append(files, file)
+		}
+	}
+	ctx.uploadfiles = files
+}
+
+// Uploads returns a typed view of the uploaded files, first file per key.
+func (ctx *Context) Uploads() map[string]File {
+	uploads := make(map[string]File, len(ctx.Upload))
+	for key, val := range ctx.Upload {
+		files := uploadMaps(val)
+		if len(files) == 0 {
+			continue
+		}
+		file := File{}
+		if vv, ok := files[0]["name"].(string); ok {
+			file.Filename = vv
+		}
+		if vv, ok := files[0]["type"].(string); ok {
+			file.Extension = vv
+		}
+		if vv, ok := files[0]["mime"].(string); ok {
+			file.Mimetype = vv
+		}
+		if vv, ok := files[0]["size"].(int64); ok {
+			file.Length = vv
+		}
+		if vv, ok := files[0]["file"].(string); ok {
+			file.Tempfile = vv
+		}
+		if vv, ok := files[0]["charset"].(string); ok {
+			file.Charset = vv
+		}
+		uploads[key] = file
+	}
+	return uploads
+}
+
+func uploadMaps(val Any) []Map {
+	switch vv := val.(type) {
+	case Map:
+		return []Map{vv}
+	case []Map:
+		return vv
+	}
+	return nil
+}
+
 func (ctx *Context) uploadFile(patterns ...string) (*os.File, error) {
 	if dir := ctx.site.Config.Upload; dir != "" {
 		pattern := ""
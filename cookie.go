@@ -0,0 +1,109 @@
+package web
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"sync"
+)
+
+var (
+	cookieSecretOnce sync.Once
+	cookieSecretKey  []byte
+)
+
+// cookieKey derives the cookie key from Config.Secret, without a secret a
+// random key is used, so protected cookies don't survive restarts.
+func (site *Site) cookieKey() []byte {
+	if site.Config.Secret != "" {
+		key := sha256.Sum256([]byte(site.Config.Secret))
+		return key[:]
+	}
+	cookieSecretOnce.Do(func() {
+		cookieSecretKey = make([]byte, 32)
+		rand.Read(cookieSecretKey)
+	})
+	return cookieSecretKey
+}
+
+// protectedCookie reports if the cookie is listed in Config.Protect.
+func (site *Site) protectedCookie(name string) bool {
+	for _, protect := range site.Config.Protect {
+		if protect == name {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeCookie signs the value, or encrypts it with Config.Crypto.
+func (site *Site) encodeCookie(name, value string) string {
+	key := site.cookieKey()
+	if site.Config.Crypto {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return ""
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return ""
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		rand.Read(nonce)
+		sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(name))
+		return base64.RawURLEncoding.EncodeToString(sealed)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name + "=" + value))
+	return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// decodeCookie verifies and decodes a value of encodeCookie.
+func (site *Site) decodeCookie(name, value string) (string, bool) {
+	key := site.cookieKey()
+	if site.Config.Crypto {
+		sealed, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return "", false
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return "", false
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil || len(sealed) < gcm.NonceSize() {
+			return "", false
+		}
+		size := gcm.NonceSize()
+		plain, err := gcm.Open(nil, sealed[:size], sealed[size:], []byte(name))
+		if err != nil {
+			return "", false
+		}
+		return string(plain), true
+	}
+
+	idx := strings.LastIndex(value, ".")
+	if idx < 0 {
+		return "", false
+	}
+	plain, err := base64.RawURLEncoding.DecodeString(value[:idx])
+	if err != nil {
+		return "", false
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(value[idx+1:])
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name + "=" + string(plain)))
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return "", false
+	}
+	return string(plain), true
+}
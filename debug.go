@@ -0,0 +1,113 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	. "github.com/bamgoo/base"
+)
+
+const dumpBodyLimit = 4096
+
+var dumpRedacts = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie"}
+
+// dumpSecrets are parts of param, query and form keys holding secrets.
+var dumpSecrets = []string{"password", "passwd", "secret", "token", "apikey", "api_key", "credential", "authorization"}
+
+// Dump returns the request as a map for debugging, secrets are redacted.
+func (ctx *Context) Dump() Map {
+	headers := Map{}
+	for key, vals := range ctx.reader.Header {
+		key = http.CanonicalHeaderKey(key)
+		if containsString(dumpRedacts, key) {
+			headers[key] = "[redacted]"
+		} else if len(vals) == 1 {
+			headers[key] = vals[0]
+		} else {
+			headers[key] = vals
+		}
+	}
+
+	body := ctx.rawBody
+	truncated := false
+	if len(body) > dumpBodyLimit {
+		body = body[:dumpBodyLimit]
+		truncated = true
+	}
+	// The body repeats the form, so it goes with a secret form value.
+	form, redacted := redactSecrets(ctx.Form)
+	if redacted {
+		body = []byte("[redacted]")
+		truncated = false
+	}
+	params, _ := redactSecrets(ctx.Params)
+	query, _ := redactSecrets(ctx.Query)
+
+	dump := Map{
+		"method":  ctx.Method,
+		"path":    ctx.Path,
+		"uri":     ctx.Uri,
+		"host":    ctx.Host,
+		"site":    ctx.site.Name,
+		"route":   ctx.Name,
+		"ip":      ctx.IP(),
+		"headers": headers,
+		"params":  params,
+		"query":   query,
+		"form":    form,
+		"body":    string(body),
+	}
+	if truncated {
+		dump["truncated"] = true
+	}
+	return dump
+}
+
+// redactSecrets copies the values with secret keys redacted, reporting
+// if any was.
+func redactSecrets(values Map) (Map, bool) {
+	redacted := false
+	out := make(Map, len(values))
+	for key, val := range values {
+		out[key] = val
+		lower := strings.ToLower(key)
+		for _, secret := range dumpSecrets {
+			if strings.Contains(lower, secret) {
+				out[key] = "[redacted]"
+				redacted = true
+				break
+			}
+		}
+	}
+	return out, redacted
+}
+
+// debugging logs the request dump when Config.Debug or X-Debug is set,
+// see Config.DebugHeader.
+func (site *Site) debugging(ctx *Context) {
+	if site.Config.Debug || ctx.Header("X-Debug") != "" && site.debugHeader(ctx) {
+		if bytes, err := json.Marshal(ctx.Dump()); err == nil {
+			log.Printf("web request %s", bytes)
+		}
+	}
+	ctx.Next()
+}
+
+// debugHeader reports if X-Debug is honored, with Config.DebugHeader or
+// from a trusted proxy.
+func (site *Site) debugHeader(ctx *Context) bool {
+	if site.Config.DebugHeader {
+		return true
+	}
+	if len(site.Config.Proxies) == 0 {
+		return false
+	}
+	remote := ctx.reader.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	return trustedProxy(site.Config.Proxies, remote)
+}
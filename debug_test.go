@@ -0,0 +1,54 @@
+package web
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/bamgoo/base"
+)
+
+func TestDumpRedactsSecrets(t *testing.T) {
+	var dump Map
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"login": {Uri: "/login", Method: POST, Action: func(ctx *Context) {
+			dump = ctx.Dump()
+			ctx.Text("ok")
+		}},
+	})
+
+	req := httptest.NewRequest(POST, "/login?access_token=abc", strings.NewReader("user=bob&password=hunter2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	m.Serve("default.login.*", Map{}, httptest.NewRecorder(), req)
+
+	form, _ := dump["form"].(Map)
+	query, _ := dump["query"].(Map)
+	if form["password"] != "[redacted]" || form["user"] != "bob" || query["access_token"] != "[redacted]" {
+		t.Errorf("form = %v, query = %v", form, query)
+	}
+	if body, _ := dump["body"].(string); strings.Contains(body, "hunter2") {
+		t.Errorf("body leaks the password: %q", body)
+	}
+}
+
+func TestDebugHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		config Config
+		remote string
+		want   bool
+	}{
+		{"client", Config{}, "203.0.113.9:4000", false},
+		{"allowed", Config{DebugHeader: true}, "203.0.113.9:4000", true},
+		{"proxy", Config{Proxies: []string{"10.0.0.0/8"}}, "10.1.2.3:4000", true},
+		{"untrusted", Config{Proxies: []string{"10.0.0.0/8"}}, "203.0.113.9:4000", false},
+	}
+	for _, c := range cases {
+		site := &Site{Config: c.config}
+		req := httptest.NewRequest(GET, "/", nil)
+		req.RemoteAddr = c.remote
+		if got := site.debugHeader(&Context{reader: req}); got != c.want {
+			t.Errorf("%s: debugHeader = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -3,13 +3,20 @@ package web
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/bamgoo/base"
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func init() {
@@ -25,6 +32,30 @@ type (
 		server   *http.Server
 		router   *mux.Router
 		routes   map[string]*mux.Route
+		handler  atomic.Pointer[defaultHandler]
+
+		names []string
+		infos map[string]defaultRoute
+
+		// hosts of all routes, anyHost when a route matches every host.
+		hosts   map[string]struct{}
+		anyHost bool
+
+		inflight atomic.Int64
+		served   atomic.Int64
+		started  atomic.Bool
+	}
+
+	defaultRoute struct {
+		info  Info
+		hosts []string
+	}
+
+	// defaultHandler is a router generation, counting the requests it
+	// serves so a swapped out router can drain.
+	defaultHandler struct {
+		router   *mux.Router
+		inflight atomic.Int64
 	}
 )
 
@@ -32,67 +63,248 @@ func (driver *defaultDriver) Connect(inst *Instance) (Connection, error) {
 	return &defaultConnect{
 		instance: inst,
 		routes:   make(map[string]*mux.Route),
+		infos:    make(map[string]defaultRoute),
 	}, nil
 }
 
 func (c *defaultConnect) Open() error {
-	c.router = mux.NewRouter()
+	c.router = c.newRouter()
+	c.handler.Store(&defaultHandler{router: c.router})
 	c.server = &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", c.instance.Config.Host, c.instance.Config.Port),
 		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
-		Handler:      c.router,
+		Handler:      http.HandlerFunc(c.dispatch),
+	}
+	// The socket must outlive the handler deadline to send its 503.
+	if timeout := c.instance.Config.HandlerTimeout; timeout+time.Second*5 > c.server.WriteTimeout {
+		c.server.WriteTimeout = timeout + time.Second*5
+	}
+	if c.instance.Config.H2C {
+		c.server.Handler = h2c.NewHandler(c.server.Handler, &http2.Server{})
+	}
+	if c.instance.Config.MaxHeaderBytes > 0 {
+		c.server.MaxHeaderBytes = c.instance.Config.MaxHeaderBytes
 	}
-
-	c.router.NotFoundHandler = c
-	c.router.MethodNotAllowedHandler = c
 
 	return nil
 }
 
 func (c *defaultConnect) Close() error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	timeout := c.instance.Config.Shutdown
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+
+	log.Printf("web shutdown with %d in-flight requests", c.inflight.Load())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	return c.server.Shutdown(ctx)
 }
 
+func (c *defaultConnect) Stats() Stats {
+	return Stats{
+		Inflight: c.inflight.Load(),
+		Served:   c.served.Load(),
+	}
+}
+
 func (c *defaultConnect) Register(name string, info Info, hosts []string) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	useHosts := make([]string, 0, len(hosts))
-	useHosts = append(useHosts, hosts...)
+	if _, ok := c.infos[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.infos[name] = defaultRoute{info: info, hosts: append([]string{}, hosts...)}
+	c.indexHosts()
+
+	// mux routers aren't safe to change while serving, so a started
+	// server gets a rebuilt router swapped in.
+	if c.started.Load() {
+		c.rebuild()
+	} else {
+		c.register(c.router, name, info, hosts)
+	}
+	return nil
+}
 
+// Unregister removes a route, mux can't remove routes, so the router is
+// rebuilt from the remaining routes and swapped in. In-flight requests
+// keep running on the old router, Unregister returns once they finished
+// or the shutdown timeout passed.
+func (c *defaultConnect) Unregister(name string) error {
+	old := c.unregister(name)
+	if old == nil {
+		return nil
+	}
+
+	timeout := c.instance.Config.Shutdown
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+	deadline := time.Now().Add(timeout)
+	for old.inflight.Load() > 0 {
+		if time.Now().After(deadline) {
+			log.Printf("web route %s removed with %d requests still in-flight", name, old.inflight.Load())
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return nil
+}
+
+// unregister swaps in a router without the route, returning the old one.
+func (c *defaultConnect) unregister(name string) *defaultHandler {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.infos[name]; !ok {
+		return nil
+	}
+	delete(c.infos, name)
+
+	names := make([]string, 0, len(c.names))
+	for _, n := range c.names {
+		if n != name {
+			names = append(names, n)
+		}
+	}
+	c.names = names
+	c.indexHosts()
+	return c.rebuild()
+}
+
+// rebuild registers all routes on a new router and swaps it in.
+func (c *defaultConnect) rebuild() *defaultHandler {
+	router := c.newRouter()
+	c.routes = make(map[string]*mux.Route)
+	for _, n := range c.names {
+		route := c.infos[n]
+		c.register(router, n, route.info, route.hosts)
+	}
+	c.router = router
+	return c.handler.Swap(&defaultHandler{router: router})
+}
+
+// indexHosts collects the route hosts for the unmatched fast path.
+func (c *defaultConnect) indexHosts() {
+	c.hosts = make(map[string]struct{})
+	c.anyHost = false
+	for _, route := range c.infos {
+		hosted := false
+		for _, host := range route.hosts {
+			if host = normalizeHost(host); host != "" {
+				c.hosts[host] = struct{}{}
+				hosted = true
+			}
+		}
+		if !hosted {
+			c.anyHost = true
+		}
+	}
+}
+
+// knownHost reports if any route or site may serve the host, sites
+// without routes still serve static files.
+func (c *defaultConnect) knownHost(host string) bool {
+	if c.routeHost(host) {
+		return true
+	}
+	if delegate, ok := c.instance.Delegate.(HostDelegate); ok {
+		return delegate.KnownHost(host)
+	}
+	return false
+}
+
+// routeHost reports if any route may serve the host.
+func (c *defaultConnect) routeHost(host string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.anyHost {
+		return true
+	}
+	host = normalizeHost(host)
+	if _, ok := c.hosts[host]; ok {
+		return true
+	}
+	parts := strings.Split(host, ".")
+	for i := 1; i < len(parts); i++ {
+		if _, ok := c.hosts["*."+strings.Join(parts[i:], ".")]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *defaultConnect) newRouter() *mux.Router {
+	router := mux.NewRouter()
+	if c.instance.Config.UseEncodedPath {
+		router.UseEncodedPath()
+	}
+	if mode := c.instance.Config.CleanPath; mode != "" && mode != "redirect" {
+		router.SkipClean(true)
+	}
+	router.NotFoundHandler = c
+	router.MethodNotAllowedHandler = c
+	return router
+}
+
+func (c *defaultConnect) register(router *mux.Router, name string, info Info, hosts []string) {
 	register := func(routeName string, r *mux.Router) {
 		route := r.HandleFunc(info.Uri, c.ServeHTTP).Name(routeName)
-		if info.Method != "" {
+		if info.Method == GET && info.Head {
+			route.Methods(GET, HEAD)
+		} else if info.Method != "" {
 			route.Methods(info.Method)
 		}
 		c.routes[routeName] = route
 	}
 
+	useHosts := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if host != "" {
+			useHosts = append(useHosts, host)
+		}
+	}
+
 	if len(useHosts) == 0 {
-		register(name, c.router)
-		return nil
+		register(name, router)
+		return
 	}
 
 	for _, host := range useHosts {
-		if host == "" {
-			continue
-		}
 		routeName := name + "#" + host
 		host = normalizeHostPattern(host)
-		sub := c.router.Host(host).Subrouter()
+		sub := router.Host(host).Subrouter()
 		register(routeName, sub)
 	}
-	return nil
+}
+
+// dispatch serves with the current router.
+func (c *defaultConnect) dispatch(res http.ResponseWriter, req *http.Request) {
+	// Cleaning decodes the path, keep it when encoded paths are matched.
+	encoded := c.instance.Config.UseEncodedPath && req.URL.RawPath != ""
+	if c.instance.Config.CleanPath == "normalize" && !encoded {
+		if clean := cleanPath(req.URL.Path); clean != req.URL.Path {
+			req.URL.Path = clean
+			req.URL.RawPath = ""
+		}
+	}
+	handler := c.handler.Load()
+	handler.inflight.Add(1)
+	defer handler.inflight.Add(-1)
+	handler.router.ServeHTTP(res, req)
 }
 
 func (c *defaultConnect) Start() error {
 	if c.server == nil {
 		panic("Invalid web server")
 	}
+	c.started.Store(true)
 
 	go func() {
 		err := c.server.ListenAndServe()
@@ -108,6 +320,7 @@ func (c *defaultConnect) StartTLS(certFile, keyFile string) error {
 	if c.server == nil {
 		panic("Invalid web server")
 	}
+	c.started.Store(true)
 
 	go func() {
 		err := c.server.ListenAndServeTLS(certFile, keyFile)
@@ -120,6 +333,12 @@ func (c *defaultConnect) StartTLS(certFile, keyFile string) error {
 }
 
 func (c *defaultConnect) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	c.inflight.Add(1)
+	defer func() {
+		c.inflight.Add(-1)
+		c.served.Add(1)
+	}()
+
 	name := ""
 	params := Map{}
 
@@ -133,6 +352,35 @@ func (c *defaultConnect) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		for k, v := range vars {
 			params[k] = v
 		}
+		// Encoded path vars are decoded, the raw ones go in the context.
+		if c.instance.Config.UseEncodedPath && len(vars) > 0 {
+			raws := make(map[string]string, len(vars))
+			for k, v := range vars {
+				raws[k] = v
+				if unescaped, err := url.PathUnescape(v); err == nil {
+					params[k] = unescaped
+				}
+			}
+			req = req.WithContext(WithRawParams(req.Context(), raws))
+		}
+	} else if body := c.instance.Config.Unmatched; body != "" && !c.knownHost(req.Host) {
+		res.Header().Set("Content-Type", http.DetectContentType([]byte(body)))
+		res.WriteHeader(StatusNotFound)
+		res.Write([]byte(body))
+		return
+	} else {
+		probe := req
+		req = req.WithContext(WithAllowFunc(req.Context(), func() []string {
+			return c.allowed(probe)
+		}))
+	}
+
+	// Derive the request deadline from the server write timeout, so handlers
+	// can observe expiry through the request context and abort early.
+	if c.server != nil && c.server.WriteTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), c.server.WriteTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
 	}
 
 	if c.instance.Delegate != nil {
@@ -140,6 +388,50 @@ func (c *defaultConnect) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// allowed lists the methods of routes matching the request path.
+func (c *defaultConnect) allowed(req *http.Request) []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	exists := map[string]struct{}{}
+	methods := []string{}
+	for _, route := range c.routes {
+		routeMethods, err := route.GetMethods()
+		if err != nil {
+			continue
+		}
+		for _, method := range routeMethods {
+			if _, ok := exists[method]; ok {
+				continue
+			}
+			probe := req.Clone(req.Context())
+			probe.Method = method
+			match := &mux.RouteMatch{}
+			if route.Match(probe, match) {
+				exists[method] = struct{}{}
+				methods = append(methods, method)
+			}
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// cleanPath collapses slashes and resolves dot segments, keeping a trailing slash.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	clean := path.Clean(p)
+	if p[len(p)-1] == '/' && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
 func normalizeHostPattern(host string) string {
 	host = strings.TrimSpace(strings.ToLower(host))
 	if strings.HasPrefix(host, "*.") {
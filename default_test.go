@@ -0,0 +1,84 @@
+package web
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/bamgoo/base"
+)
+
+func TestDefaultUnregisterDrains(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var finished atomic.Bool
+	m, handler := openDefaultModule(t, Map{}, map[string]Router{
+		"hold": {Uri: "/hold", Method: GET, Action: func(ctx *Context) {
+			close(started)
+			<-release
+			finished.Store(true)
+			ctx.Text("done")
+		}},
+	})
+	connect := m.instance.connect.(*defaultConnect)
+	connect.started.Store(true)
+
+	go serveTest(handler, GET, "/hold")
+	<-started
+
+	unregistered := make(chan struct{})
+	go func() {
+		connect.Unregister("default.hold.*")
+		close(unregistered)
+	}()
+
+	select {
+	case <-unregistered:
+		t.Fatal("Unregister returned with a request in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-unregistered
+	if !finished.Load() {
+		t.Error("the in-flight request did not finish")
+	}
+	if res := serveTest(handler, GET, "/hold"); res.Code != http.StatusNotFound {
+		t.Errorf("removed route: %d, want 404", res.Code)
+	}
+}
+
+func TestDefaultSwapWhileServing(t *testing.T) {
+	ping := Router{Uri: "/ping", Method: GET, Action: func(ctx *Context) { ctx.Text("pong") }}
+	m, handler := openDefaultModule(t, Map{}, map[string]Router{"ping": ping})
+	connect := m.instance.connect.(*defaultConnect)
+	connect.started.Store(true)
+	info := Info{Site: "default", Router: "ping", Uri: "/extra", Method: GET}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if res := serveTest(handler, GET, "/ping"); res.Code != http.StatusOK {
+					t.Errorf("status = %d, want 200", res.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		connect.Register("default.extra.*", info, nil)
+		connect.Unregister("default.extra.*")
+	}
+	close(stop)
+	wg.Wait()
+}
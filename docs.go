@@ -0,0 +1,49 @@
+package web
+
+import (
+	_ "embed"
+	"encoding/json"
+	"strings"
+
+	. "github.com/bamgoo/base"
+)
+
+//go:embed docs.html
+var docsPage string
+
+// docsRouters are the routers of Config.Docs, the embedded api page and
+// the spec at Config.Docs/openapi.json. They go through the pipeline, so
+// filters and auth apply, and are left out of the spec.
+func (m *Module) docsRouters(docs string) map[string]Router {
+	base := "/" + strings.Trim(docs, "/")
+	spec := strings.TrimSuffix(base, "/") + "/openapi.json"
+
+	uris := []string{base}
+	if base != "/" {
+		uris = append(uris, base+"/")
+	}
+	setting := Map{"docs": true}
+
+	return map[string]Router{
+		"_docs": {
+			Method: GET, Uris: uris, Name: "API docs", Setting: setting,
+			Action: func(ctx *Context) {
+				page := strings.ReplaceAll(docsPage, "{spec}", spec)
+				ctx.Header("Cache-Control", "no-cache")
+				ctx.HTML(strings.ReplaceAll(page, "{nonce}", ctx.CSPNonce()))
+			},
+		},
+		"_docs.openapi": {
+			Method: GET, Uri: spec, Name: "OpenAPI spec", Setting: setting,
+			Action: func(ctx *Context) {
+				doc, err := m.OpenAPI(ctx.site.Name)
+				if err != nil {
+					ctx.Status(StatusInternalServerError)
+					return
+				}
+				ctx.Header("Cache-Control", "no-cache")
+				ctx.JSON(json.RawMessage(doc))
+			},
+		},
+	}
+}
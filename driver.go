@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"net/http"
 
 	. "github.com/bamgoo/base"
@@ -18,9 +19,18 @@ type (
 		Close() error
 
 		Register(name string, info Info, hosts []string) error
+		Unregister(name string) error
 
 		Start() error
 		StartTLS(certFile, keyFile string) error
+
+		Stats() Stats
+	}
+
+	// Stats contains connection runtime statistics.
+	Stats struct {
+		Inflight int64
+		Served   int64
 	}
 
 	// Delegate handles web requests.
@@ -28,11 +38,65 @@ type (
 		Serve(name string, params Map, res http.ResponseWriter, req *http.Request)
 	}
 
+	// HostDelegate is a Delegate knowing the site hosts, drivers ask it
+	// about hosts no route matched.
+	HostDelegate interface {
+		KnownHost(host string) bool
+	}
+
 	// Info contains route information.
 	Info struct {
+		Site   string
 		Method string
 		Uri    string
 		Router string
+		Name   string
 		Args   Vars
+		Sign   bool
+		Auth   bool
+
+		Priority int
+		// Head serves HEAD on GET routes.
+		Head bool
 	}
 )
+
+type (
+	allowKey     struct{}
+	rawParamsKey struct{}
+)
+
+// WithAllow returns a request context carrying the methods allowed for
+// the path, drivers set it when no route matched the request method.
+func WithAllow(ctx context.Context, methods []string) context.Context {
+	return context.WithValue(ctx, allowKey{}, methods)
+}
+
+// WithAllowFunc is WithAllow with the methods listed on demand, only
+// requests answered with 405 or automatic OPTIONS pay for the lookup.
+func WithAllowFunc(ctx context.Context, methods func() []string) context.Context {
+	return context.WithValue(ctx, allowKey{}, methods)
+}
+
+// WithRawParams returns a request context carrying the still encoded
+// route params, drivers matching the escaped path set it.
+func WithRawParams(ctx context.Context, params map[string]string) context.Context {
+	return context.WithValue(ctx, rawParamsKey{}, params)
+}
+
+func rawParams(ctx context.Context) map[string]string {
+	if params, ok := ctx.Value(rawParamsKey{}).(map[string]string); ok {
+		return params
+	}
+	return nil
+}
+
+func allowedMethods(ctx context.Context) []string {
+	switch methods := ctx.Value(allowKey{}).(type) {
+	case []string:
+		return methods
+	case func() []string:
+		return methods()
+	}
+	return nil
+}
@@ -2,4 +2,8 @@ module github.com/bamgoo/web
 
 go 1.25.3
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/gorilla/mux v1.8.1
+	golang.org/x/net v0.48.0
+	golang.org/x/text v0.32.0
+)
@@ -1,10 +1,17 @@
 package web
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bamgoo/bamgoo"
 	. "github.com/bamgoo/base"
@@ -16,8 +23,8 @@ func (site *Site) newContext() *Context {
 		Meta:        bamgoo.NewMeta(),
 		uploadfiles: make([]string, 0),
 		headers:     make(map[string]string, 0),
-		cookies:     make(map[string]http.Cookie, 0),
-		charset:     UTF8,
+		cookies:     make([]http.Cookie, 0),
+		charset:     site.Config.Charset,
 		Params:      Map{},
 		Query:       Map{},
 		Form:        Map{},
@@ -29,10 +36,26 @@ func (site *Site) newContext() *Context {
 		Setting:     Map{},
 	}
 	ctx.Url = webUrl{ctx: ctx}
+	ctx.Timing.Start = time.Now()
+	if ctx.charset == "" {
+		ctx.charset = UTF8
+	}
+	if site.Config.Language != "" {
+		ctx.Language(site.Config.Language)
+	}
 	return ctx
 }
 
 func (site *Site) close(ctx *Context) {
+	// The action deadline lasts until the response is sent.
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+	if ctx.begun {
+		for i := len(site.finishFilters) - 1; i >= 0; i-- {
+			site.finishFilters[i](ctx)
+		}
+	}
 	for _, file := range ctx.uploadfiles {
 		os.Remove(file)
 	}
@@ -42,11 +65,18 @@ func (site *Site) close(ctx *Context) {
 func (site *Site) Serve(name string, params Map, res http.ResponseWriter, req *http.Request) {
 	ctx := site.newContext()
 
+	if site.accessLog != nil {
+		writer := &httpStatusWriter{ResponseWriter: res}
+		res = writer
+		defer site.accessLog.log(ctx, writer, time.Now())
+	}
+
 	ctx.reader = req
 	ctx.writer = res
 
 	if info, ok := site.routerInfos[name]; ok {
 		ctx.Name = info.Router
+		ctx.route = info.Uri
 		if cfg, ok := site.routers[ctx.Name]; ok {
 			ctx.Config = cfg
 			ctx.Setting = cfg.Setting
@@ -72,6 +102,29 @@ func (site *Site) Serve(name string, params Map, res http.ResponseWriter, req *h
 }
 
 func (site *Site) open(ctx *Context) {
+	if module.inMaintenance(ctx.Name) {
+		site.maintaining(ctx)
+		return
+	}
+
+	// A saturated site answers 503, other sites keep their own slots.
+	// The slot is held until the action returned, even after a timeout,
+	// and goes back to the channel it came from.
+	if slots := site.slots; slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			ctx.Unavailable(time.Second)
+			site.response(ctx)
+			return
+		}
+	}
+
+	if ctx.Name == "" && ctx.Path == "/favicon.ico" && site.favicon(ctx) {
+		return
+	}
+
 	ctx.clear()
 
 	ctx.next(site.preprocessing)
@@ -81,7 +134,35 @@ func (site *Site) open(ctx *Context) {
 	ctx.Next()
 }
 
+// favicon answers /favicon.ico outside the pipeline, unless it is a
+// static file.
+func (site *Site) favicon(ctx *Context) bool {
+	if file := site.Config.Favicon; file != "" {
+		ctx.ServeFile(file, FileOptions{Type: "image/x-icon", Inline: true, MaxAge: time.Hour * 24 * 30})
+	} else if resolveStaticFile(site.Config.Static, ctx.Path, nil) == "" {
+		ctx.Header("Cache-Control", "public, max-age=86400")
+		ctx.Status(StatusNoContent, "")
+	} else {
+		return false
+	}
+	site.response(ctx)
+	return true
+}
+
+// maintaining answers 503, Setting["maintenance"] overrides the text.
+func (site *Site) maintaining(ctx *Context) {
+	text := ""
+	if site.Setting != nil {
+		if vv, ok := site.Setting["maintenance"].(string); ok && vv != "" {
+			text = vv
+		}
+	}
+	ctx.Unavailable(time.Minute, text)
+	site.response(ctx)
+}
+
 func (site *Site) serve(ctx *Context) {
+	ctx.Timing.Serve = time.Now()
 	ctx.clear()
 
 	ctx.next(site.finding)
@@ -97,17 +178,33 @@ func (site *Site) request(ctx *Context) {
 	ctx.clear()
 
 	ctx.next(site.crossing)
+	ctx.next(site.consuming)
+	ctx.next(site.producing)
+	ctx.next(site.phaseFilters[PhasePreParse]...)
 	ctx.next(site.parsing)
+	ctx.next(site.debugging)
+	ctx.next(site.phaseFilters[PhasePreAuth]...)
 	ctx.next(site.authorizing)
 	ctx.next(site.arguing)
+	ctx.next(site.caching)
+	ctx.next(site.phaseFilters[PhasePreExecute]...)
 	ctx.next(site.execute)
 
 	ctx.Next()
 }
 
 func (site *Site) execute(ctx *Context) {
+	ctx.Timing.Execute = time.Now()
 	ctx.clear()
 
+	ctx.begun = true
+	for _, begin := range site.beginFilters {
+		begin(ctx)
+	}
+
+	if site.Config.Debug {
+		ctx.next(site.recovering)
+	}
 	ctx.next(site.executeFilters...)
 	if ctx.Config.Actions != nil && len(ctx.Config.Actions) > 0 {
 		ctx.next(ctx.Config.Actions...)
@@ -116,10 +213,123 @@ func (site *Site) execute(ctx *Context) {
 		ctx.next(ctx.Config.Action)
 	}
 
-	ctx.Next()
+	timeout := ctx.Config.Timeout
+	if timeout <= 0 {
+		timeout = site.Config.HandlerTimeout
+	}
+	if timeout <= 0 {
+		ctx.Next()
+		return
+	}
+	site.timeout(ctx, timeout)
+}
+
+// timeout runs the action with a deadline, on expiry the context is
+// canceled and 503 is answered. The action's later writes are dropped,
+// and the request waits for it to return before closing the context.
+func (site *Site) timeout(ctx *Context, timeout time.Duration) {
+	deadline, cancel := context.WithTimeout(ctx.reader.Context(), timeout)
+	ctx.cancel = cancel
+	ctx.reader = ctx.reader.WithContext(deadline)
+	writer := &httpTimeoutWriter{ResponseWriter: ctx.writer, header: ctx.writer.Header().Clone()}
+	ctx.writer = writer
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The goroutine is past the server's recover, panics are 500.
+		defer func() {
+			if r := recover(); r != nil {
+				ctx.panicked = fmt.Sprintf("panic: %v\n\n%s", r, debug.Stack())
+				ctx.Code = StatusInternalServerError
+				site.error(ctx)
+			}
+		}()
+		ctx.Next()
+	}()
+
+	select {
+	case <-done:
+	case <-deadline.Done():
+		writer.expire(retryAfter(timeout))
+		<-done
+		ctx.timedOut.Store(true)
+	}
+}
+
+// httpTimeoutWriter guards the response of an action with a deadline,
+// once the deadline answered 503 the action's writes are dropped. The
+// headers are kept apart until written, so the 503 doesn't race them.
+type httpTimeoutWriter struct {
+	http.ResponseWriter
+	mutex   sync.Mutex
+	header  http.Header
+	wrote   bool
+	expired bool
+}
+
+func (w *httpTimeoutWriter) Header() http.Header {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	// Trailers are set after the body, on the sent header.
+	if w.wrote {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *httpTimeoutWriter) WriteHeader(code int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.writeHeader(code)
+}
+
+func (w *httpTimeoutWriter) writeHeader(code int) {
+	if w.wrote || w.expired {
+		return
+	}
+	w.wrote = true
+	header := w.ResponseWriter.Header()
+	clear(header)
+	for key, vals := range w.header {
+		header[key] = vals
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *httpTimeoutWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.expired {
+		return 0, http.ErrHandlerTimeout
+	}
+	w.writeHeader(StatusOK)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *httpTimeoutWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.expired {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// expire answers 503 unless the action already started its response.
+func (w *httpTimeoutWriter) expire(retry string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.wrote {
+		w.ResponseWriter.Header().Set("Retry-After", retry)
+		http.Error(w.ResponseWriter, StatusText(StatusServiceUnavailable), StatusServiceUnavailable)
+	}
+	w.expired = true
 }
 
 func (site *Site) response(ctx *Context) {
+	if ctx.abandon() {
+		return
+	}
 	ctx.clear()
 
 	ctx.next(site.responseFilters...)
@@ -128,8 +338,9 @@ func (site *Site) response(ctx *Context) {
 	site.body(ctx)
 }
 
-func (site *Site) found(ctx *Context) {
+func (site *Site) found(ctx *Context, reason string) {
 	ctx.clear()
+	ctx.foundReason = reason
 
 	if ctx.Code <= 0 {
 		ctx.Code = StatusNotFound
@@ -145,7 +356,59 @@ func (site *Site) found(ctx *Context) {
 }
 
 func (site *Site) foundDefault(ctx *Context) {
-	ctx.Text("Not Found", StatusNotFound)
+	if site.errorPage(ctx, StatusNotFound) {
+		return
+	}
+	text := "Not Found"
+	// Suggestions show the routes, so only in debug.
+	if site.Config.Debug && ctx.foundReason != FoundAction {
+		if uri := site.suggest(ctx.Path); uri != "" {
+			text += "\n\nDid you mean " + uri + "?"
+		}
+	}
+	ctx.Text(text, StatusNotFound)
+}
+
+// suggest finds the route uri closest to the path by edit distance.
+func (site *Site) suggest(p string) string {
+	best, bestDist := "", -1
+	for _, info := range site.routerInfos {
+		if info.Uri == "" || info.Uri == p {
+			continue
+		}
+		dist := editDistance(p, info.Uri)
+		if bestDist < 0 || dist < bestDist || dist == bestDist && info.Uri < best {
+			best, bestDist = info.Uri, dist
+		}
+	}
+	limit := len(p) / 3
+	if limit < 3 {
+		limit = 3
+	}
+	if bestDist < 0 || bestDist > limit {
+		return ""
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
 }
 
 func (site *Site) error(ctx *Context) {
@@ -165,7 +428,32 @@ func (site *Site) error(ctx *Context) {
 }
 
 func (site *Site) errorDefault(ctx *Context) {
-	ctx.Text("Internal Server Error", StatusInternalServerError)
+	if site.errorPage(ctx, StatusInternalServerError) {
+		return
+	}
+	text := "Internal Server Error"
+	// Only Config.Debug exposes details, never a request header.
+	if site.Config.Debug {
+		if ctx.panicked != "" {
+			text += "\n\n" + ctx.panicked
+		} else if ctx.result != nil && ctx.result.Error() != "" {
+			text += "\n\n" + ctx.result.Error()
+		}
+	}
+	ctx.Text(text, StatusInternalServerError)
+}
+
+// recovering turns action panics into errors with the stack, it only runs
+// with Config.Debug, so errorDefault can show them.
+func (site *Site) recovering(ctx *Context) {
+	defer func() {
+		if r := recover(); r != nil {
+			ctx.panicked = fmt.Sprintf("panic: %v\n\n%s", r, debug.Stack())
+			ctx.Code = StatusInternalServerError
+			site.error(ctx)
+		}
+	}()
+	ctx.Next()
 }
 
 func (site *Site) failed(ctx *Context) {
@@ -185,7 +473,14 @@ func (site *Site) failed(ctx *Context) {
 }
 
 func (site *Site) failedDefault(ctx *Context) {
-	ctx.Text("Bad Request", StatusBadRequest)
+	code := StatusBadRequest
+	if ctx.rejected > 0 {
+		code = ctx.rejected
+	}
+	if site.errorPage(ctx, code) {
+		return
+	}
+	ctx.Text(StatusText(code), code)
 }
 
 func (site *Site) denied(ctx *Context) {
@@ -205,5 +500,121 @@ func (site *Site) denied(ctx *Context) {
 }
 
 func (site *Site) deniedDefault(ctx *Context) {
+	if site.errorPage(ctx, StatusUnauthorized) {
+		return
+	}
 	ctx.Text("Unauthorized", StatusUnauthorized)
 }
+
+// errorPage is a page of Setting["errorPages"], typed by its extension.
+type errorPage struct {
+	data []byte
+	kind string
+}
+
+// loadErrorPages reads the pages of Setting["errorPages"] by status code,
+// a page that can't be read is an invalid config.
+func loadErrorPages(setting Map) map[int]errorPage {
+	if setting == nil {
+		return nil
+	}
+	pages, ok := setting["errorPages"].(Map)
+	if !ok {
+		if pages, ok = setting["errorpages"].(Map); !ok {
+			return nil
+		}
+	}
+	loaded := make(map[int]errorPage, len(pages))
+	for key, val := range pages {
+		code, err := strconv.Atoi(key)
+		if err != nil || code < 100 || code > 599 {
+			panic("Invalid web error page: " + key)
+		}
+		file, _ := val.(string)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			panic("Invalid web error page: " + key + " " + file)
+		}
+		kind := strings.TrimPrefix(strings.ToLower(path.Ext(file)), ".")
+		if kind == "" || kind == "htm" {
+			kind = "html"
+		}
+		loaded[code] = errorPage{data, kind}
+	}
+	return loaded
+}
+
+// errorPage serves the page of Setting["errorPages"] for the code.
+func (site *Site) errorPage(ctx *Context, code int) bool {
+	page, ok := site.errorPages[code]
+	if !ok {
+		return false
+	}
+	ctx.Type = page.kind
+	if page.kind == "html" {
+		ctx.HTML(string(page.data), code)
+	} else {
+		ctx.Text(string(page.data), code)
+	}
+	return true
+}
+
+// scopeFilter wraps the filter funcs to skip requests not matching Match.
+func scopeFilter(filter Filter) Filter {
+	if len(filter.Match) == 0 {
+		return filter
+	}
+	patterns := filter.Match
+	chain := func(fn ctxFunc) ctxFunc {
+		if fn == nil {
+			return nil
+		}
+		return func(ctx *Context) {
+			if filterMatched(patterns, ctx) {
+				fn(ctx)
+			} else {
+				ctx.Next()
+			}
+		}
+	}
+	hook := func(fn ctxFunc) ctxFunc {
+		if fn == nil {
+			return nil
+		}
+		return func(ctx *Context) {
+			if filterMatched(patterns, ctx) {
+				fn(ctx)
+			}
+		}
+	}
+	filter.Serve = chain(filter.Serve)
+	filter.Request = chain(filter.Request)
+	filter.Execute = chain(filter.Execute)
+	filter.Response = chain(filter.Response)
+	filter.Begin = hook(filter.Begin)
+	filter.Finish = hook(filter.Finish)
+	return filter
+}
+
+func filterMatched(patterns []string, ctx *Context) bool {
+	for _, pattern := range patterns {
+		for _, value := range []string{ctx.Name, ctx.Path} {
+			if value == "" {
+				continue
+			}
+			if matchGlob(pattern, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchGlob matches path globs, a trailing * matches any suffix.
+func matchGlob(pattern, value string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(value, prefix) {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
@@ -0,0 +1,137 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/bamgoo/base"
+)
+
+func TestTimeoutWaitsForAction(t *testing.T) {
+	var returned atomic.Bool
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"slow": {Uri: "/slow", Method: GET, Timeout: 20 * time.Millisecond, Action: func(ctx *Context) {
+			<-ctx.Context().Done()
+			time.Sleep(20 * time.Millisecond)
+			ctx.Text("late")
+			returned.Store(true)
+		}},
+	})
+
+	res := httptest.NewRecorder()
+	m.Serve("default.slow.*", Map{}, res, httptest.NewRequest(GET, "/slow", nil))
+	if res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") != "1" {
+		t.Errorf("response = %d Retry-After %q, want 503", res.Code, res.Header().Get("Retry-After"))
+	}
+	if res.Body.String() == "late" {
+		t.Error("the timed out action wrote its response")
+	}
+	if !returned.Load() {
+		t.Error("the request closed before the action returned")
+	}
+}
+
+func TestTimeoutStreamingAction(t *testing.T) {
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"stream": {Uri: "/stream", Method: GET, Timeout: 20 * time.Millisecond, Action: func(ctx *Context) {
+			mp := ctx.Multipart()
+			for i := 0; i < 20; i++ {
+				mp.Binary([]byte("tick"), "text/plain")
+				time.Sleep(2 * time.Millisecond)
+			}
+		}},
+	})
+
+	res := httptest.NewRecorder()
+	m.Serve("default.stream.*", Map{}, res, httptest.NewRequest(GET, "/stream", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("status = %d, want the started 200", res.Code)
+	}
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"panic": {Uri: "/panic", Method: GET, Timeout: time.Second, Action: func(ctx *Context) {
+			panic("broken")
+		}},
+	})
+
+	res := httptest.NewRecorder()
+	m.Serve("default.panic.*", Map{}, res, httptest.NewRequest(GET, "/panic", nil))
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", res.Code)
+	}
+}
+
+func TestMaxConcurrentPerSite(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	m, _ := openTestModule(t, Map{
+		"site": Map{
+			"busy": Map{"domain": "busy.example.com", "maxconcurrent": 1},
+			"calm": Map{"domain": "calm.example.com", "maxconcurrent": 1},
+		},
+	}, map[string]Router{
+		"busy.hold": {Uri: "/hold", Method: GET, Timeout: 10 * time.Millisecond, Action: func(ctx *Context) {
+			close(started)
+			<-release
+		}},
+		"*.ping": {Uri: "/ping", Method: GET, Action: func(ctx *Context) { ctx.Text("pong") }},
+	})
+	serve := func(name, target string) int {
+		res := httptest.NewRecorder()
+		m.Serve(name, Map{}, res, httptest.NewRequest(GET, target, nil))
+		return res.Code
+	}
+
+	done := make(chan int)
+	go func() { done <- serve("busy.hold.*", "http://busy.example.com/hold") }()
+	<-started
+	// The hold action timed out but still runs, so it keeps the slot.
+	time.Sleep(30 * time.Millisecond)
+
+	if code := serve("busy.ping.*", "http://busy.example.com/ping"); code != http.StatusServiceUnavailable {
+		t.Errorf("saturated site: %d, want 503", code)
+	}
+	if code := serve("calm.ping.*", "http://calm.example.com/ping"); code != http.StatusOK {
+		t.Errorf("other site: %d, want 200", code)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusServiceUnavailable {
+		t.Errorf("timed out action: %d, want 503", code)
+	}
+	if code := serve("busy.ping.*", "http://busy.example.com/ping"); code != http.StatusOK {
+		t.Errorf("released site: %d, want 200", code)
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "404.json")
+	os.WriteFile(page, []byte(`{"error":"not found"}`), 0644)
+	m, _ := openTestModule(t, Map{"web": Map{"setting": Map{"errorPages": Map{"404": page}}}}, nil)
+
+	// the page is kept from setup, not read per request
+	os.Remove(page)
+	res := httptest.NewRecorder()
+	m.Serve("", Map{}, res, httptest.NewRequest(GET, "/missing", nil))
+	if res.Code != http.StatusNotFound || res.Body.String() != `{"error":"not found"}` {
+		t.Errorf("404 page: %d %q", res.Code, res.Body.String())
+	}
+	if ctype := res.Header().Get("Content-Type"); !strings.Contains(ctype, "json") {
+		t.Errorf("content type = %q, want json", ctype)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("a missing error page passed setup")
+		}
+	}()
+	openTestModule(t, Map{"web": Map{"setting": Map{"errorPages": Map{"500": page}}}}, nil)
+}
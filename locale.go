@@ -0,0 +1,75 @@
+package web
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bamgoo/bamgoo"
+	. "github.com/bamgoo/base"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// T translates the key in the detected language, like ctx.String.
+func (ctx *Context) T(key string, args ...Any) string {
+	return ctx.String(key, args...)
+}
+
+// Locale returns the locale tag of the detected language, the first of its
+// accepts, like zh-CN.
+func (ctx *Context) Locale() string {
+	lang := ctx.Language()
+	if config, ok := bamgoo.Languages()[lang]; ok && len(config.Accepts) > 0 {
+		return config.Accepts[0]
+	}
+	return lang
+}
+
+func (ctx *Context) printer() *message.Printer {
+	tag, err := language.Parse(strings.ReplaceAll(ctx.Locale(), "_", "-"))
+	if err != nil {
+		tag = language.English
+	}
+	return message.NewPrinter(tag)
+}
+
+// Number formats a number with the digit grouping of the locale. Strings,
+// json.Number and other fmt.Stringer numbers like decimals are parsed
+// first, values that are not numbers are returned as they are.
+func (ctx *Context) Number(num Any) string {
+	switch vv := num.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return ctx.printer().Sprintf("%d", vv)
+	case float32, float64:
+		return ctx.printer().Sprintf("%.2f", vv)
+	case string:
+		return ctx.numberText(vv)
+	case fmt.Stringer:
+		return ctx.numberText(vv.String())
+	}
+	return fmt.Sprint(num)
+}
+
+func (ctx *Context) numberText(text string) string {
+	text = strings.TrimSpace(text)
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return ctx.printer().Sprintf("%d", n)
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return ctx.printer().Sprintf("%.2f", f)
+	}
+	return text
+}
+
+// Date formats the time in the context timezone, the layout defaults to
+// time.DateTime.
+func (ctx *Context) Date(t time.Time, layouts ...string) string {
+	layout := time.DateTime
+	if len(layouts) > 0 && layouts[0] != "" {
+		layout = layouts[0]
+	}
+	return t.In(ctx.Timezone()).Format(layout)
+}
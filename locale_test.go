@@ -0,0 +1,39 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/bamgoo/base"
+)
+
+func TestNumber(t *testing.T) {
+	cases := []struct {
+		num  Any
+		want string
+	}{
+		{1234567, "1,234,567"},
+		{uint8(200), "200"},
+		{1234.5, "1,234.50"},
+		{"1234567", "1,234,567"},
+		{json.Number("1234.5"), "1,234.50"},
+		{"n/a", "n/a"},
+		{true, "true"},
+	}
+	got := make([]string, len(cases))
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"number": {Uri: "/number", Method: GET, Action: func(ctx *Context) {
+			for i, c := range cases {
+				got[i] = ctx.Number(c.num)
+			}
+			ctx.Text("ok")
+		}},
+	})
+	m.Serve("default.number.*", Map{}, httptest.NewRecorder(), httptest.NewRequest(GET, "/number", nil))
+	for i, c := range cases {
+		if got[i] != c.want {
+			t.Errorf("Number(%#v) = %q, want %q", c.num, got[i], c.want)
+		}
+	}
+}
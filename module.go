@@ -1,17 +1,22 @@
 package web
 
 import (
+	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bamgoo/bamgoo"
 	. "github.com/bamgoo/base"
+	"golang.org/x/net/idna"
 )
 
 func init() {
@@ -19,13 +24,19 @@ func init() {
 }
 
 var module = &Module{
-	defaultConfig: Config{Driver: DEFAULT, Charset: UTF8, Port: 8080},
+	defaultConfig: Config{Driver: DEFAULT, Charset: UTF8, Port: 8080, JSONEscapeHTML: true},
 	cross:         Cross{Allow: true},
 	drivers:       make(map[string]Driver),
 	configs:       make(map[string]Config),
+	registered:    make(map[string]Config),
+	crosses:       make(map[string]Map),
 	routers:       make(map[string]Router),
+	routerSources: make(map[string]string),
 	filters:       make(map[string]Filter),
 	handlers:      make(map[string]Handler),
+	sinks:         make(map[string]UploadSink),
+	rollbacks:     make(map[string]UploadRollback),
+	serializers:   make(map[string]Serializer),
 	sites:         make(map[string]*Site),
 	siteHosts:     make(map[string]string),
 	defaultSite:   bamgoo.DEFAULT,
@@ -33,7 +44,7 @@ var module = &Module{
 
 type (
 	Module struct {
-		mutex sync.Mutex
+		mutex sync.RWMutex
 
 		opened  bool
 		started bool
@@ -44,15 +55,36 @@ type (
 		drivers map[string]Driver
 		config  Config
 		configs map[string]Config
+		crosses map[string]Map
 
-		routers  map[string]Router
-		filters  map[string]Filter
-		handlers map[string]Handler
+		// registered keeps the RegisterConfig sites, Reconfigure starts
+		// over from them.
+		registered map[string]Config
+
+		routers   map[string]Router
+		filters   map[string]Filter
+		handlers  map[string]Handler
+		sinks     map[string]UploadSink
+		rollbacks map[string]UploadRollback
+		envelope  Envelope
+		cbor      CBOR
+
+		serializers map[string]Serializer
+
+		// routerSources and duplicates report ignored duplicate routers.
+		routerSources map[string]string
+		duplicates    []string
 
 		sites       map[string]*Site
 		siteHosts   map[string]string
 		defaultSite string
 
+		// draining holds the Retry-After of requests coming in while
+		// closing, zero otherwise.
+		draining          atomic.Int64
+		maintenance       bool
+		maintenanceExempt []string
+
 		instance *Instance
 	}
 
@@ -63,8 +95,38 @@ type (
 
 		CertFile string
 		KeyFile  string
-
-		Charset string
+		H2C      bool
+
+		// Trace parses and echoes W3C traceparent, see ctx.Trace. RequestId
+		// names a request id header, echoed or generated, like X-Request-Id.
+		Trace     bool
+		RequestId string
+
+		// Debug logs request dumps and shows error details in 500 responses.
+		// X-Debug logs the dump of a single request, it is only honored
+		// from trusted Proxies, or from anyone with DebugHeader.
+		Debug       bool
+		DebugHeader bool
+
+		Charset    string
+		Language   string
+		PrettyJSON bool
+		// SemicolonQuery treats ; as a query separator like &.
+		SemicolonQuery bool
+		// JSONEscapeHTML escapes <, > and & in JSON responses, on by
+		// default, false keeps them as is.
+		JSONEscapeHTML bool
+
+		Shutdown time.Duration
+
+		MaxHeaderBytes int
+		MaxHeaders     int
+		// MaxConcurrent bounds the requests a site serves at once.
+		MaxConcurrent int
+
+		// TokenSources orders where the token comes from: header, cookie
+		// and query, like "query:token" with its param name.
+		TokenSources []string
 
 		Cookie   string
 		Token    bool
@@ -72,16 +134,108 @@ type (
 		Crypto   bool
 		MaxAge   time.Duration
 		HttpOnly bool
+		// Protect lists cookies set with ctx.Cookie that are signed, or
+		// encrypted with Crypto, using Secret.
+		Protect []string
+		Secret  string
 
 		Upload   string
 		Static   string
 		Shared   string
 		Defaults []string
 
+		MaxUploadFiles int
+		MaxUploadTotal int64
+		// Buffered sends text, html and json bodies with Content-Length,
+		// Setting["buffered"] overrides it per route.
+		Buffered bool
+
+		// CopyBufferSize is the buffer of streaming copies, 32KB by default.
+		CopyBufferSize int
+
+		// StrictLength rejects bodies not matching Content-Length with 400.
+		StrictLength bool
+		// MaxBodySize limits json request bodies and rejects larger declared
+		// Content-Length early with 413, zero means no limit.
+		MaxBodySize int64
+
+		// Precedence lists ctx.Value sources highest first, the sources
+		// are params, query, form and upload.
+		Precedence []string
+
+		// UseEncodedPath matches routes against the escaped path, so %2F
+		// stays inside a param, see ctx.ParamRaw.
+		UseEncodedPath bool
+
+		// CleanPath handles unclean paths like /a//b/../c: "redirect" (default)
+		// answers 301 to the clean path, "normalize" routes the clean path
+		// transparently, "off" keeps the path as is.
+		CleanPath string
+
+		// AutoOptions answers OPTIONS of all routes with 204 and Allow,
+		// except cross preflights. NoAutoHead stops GET routes serving HEAD.
+		AutoOptions bool
+		NoAutoHead  bool
+
+		// StrictRouting panics when a router Action and Routing overlap, or
+		// a router name is registered twice without override.
+		StrictRouting bool
+
+		// IndexRedirect redirects directory urls without trailing slash.
+		IndexRedirect bool
+
+		// SharedDirs lists shared roots searched in order, relative to Static.
+		SharedDirs []string
+		// DeviceStatic serves Static/mobile or Static/tablet files first to
+		// those devices, see ctx.DeviceType.
+		DeviceStatic bool
+
+		// RealIP lists client ip headers ctx.IP consults first, like
+		// CF-Connecting-IP. Proxies lists trusted proxy ips or cidrs, when
+		// set headers are only used for requests from them.
+		RealIP  []string
+		Proxies []string
+
+		// HandlerTimeout limits every action, see Router.Timeout, expired
+		// actions get their context canceled and the request 503.
+		HandlerTimeout time.Duration
+
+		// Headers are set on every response, ctx.Header and the body
+		// headers like Content-Type override them.
+		Headers map[string]string
+
+		// CSP is the Content-Security-Policy of html responses, {nonce} is
+		// replaced with ctx.CSPNonce.
+		CSP string
+
+		// Favicon is served for /favicon.ico with long cache headers, without
+		// it and a static favicon.ico the answer is 204 instead of 404.
+		Favicon string
+		// Docs serves an embedded api page at this path like /docs, with
+		// the generated OpenAPI spec at /docs/openapi.json. Both are routes
+		// of the site, so its filters apply.
+		Docs string
+
 		Domain  string
 		Domains []string
 
+		// NoDefault disables the implicit default site, requests of
+		// unknown hosts get 421 instead of the default site.
+		NoDefault bool
+		// Misdirected answers 421 for hosts not matching any site domain.
+		Misdirected bool
+		// StrictHost answers 400 for a missing or blank Host instead of
+		// falling back to the default site.
+		StrictHost bool
+		// Unmatched is answered with 404 by the default driver for requests
+		// matching no route of any host, skipping site resolution.
+		Unmatched string
+
 		Setting Map
+
+		// disabled holds bools set false by config, so merging turns
+		// them off instead of keeping the base value.
+		disabled map[string]bool
 	}
 
 	Configs map[string]Config
@@ -94,6 +248,16 @@ type (
 		Origins []string
 		Header  string
 		Headers []string
+		Expose  []string
+
+		// Paths scopes policies to path globs, the most specific first,
+		// unmatched paths use this policy.
+		Paths []CrossPath
+	}
+
+	CrossPath struct {
+		Path string
+		Cross
 	}
 
 	Instance struct {
@@ -115,11 +279,18 @@ type (
 		handlers map[string]Handler
 
 		routerInfos map[string]Info
+		cache       *httpCache
+		accessLog   *accessLog
+		slots       chan struct{}
+		errorPages  map[int]errorPage
 
 		serveFilters    []ctxFunc
 		requestFilters  []ctxFunc
 		executeFilters  []ctxFunc
 		responseFilters []ctxFunc
+		beginFilters    []ctxFunc
+		finishFilters   []ctxFunc
+		phaseFilters    map[string][]ctxFunc
 
 		foundHandlers  []ctxFunc
 		errorHandlers  []ctxFunc
@@ -143,6 +314,18 @@ func (m *Module) Register(name string, value Any) {
 		m.RegisterFilter(name, v)
 	case Handler:
 		m.RegisterHandler(name, v)
+	case UploadSink:
+		m.RegisterUploadSink(name, v)
+	case UploadRollback:
+		m.RegisterUploadRollback(name, v)
+	case Envelope:
+		m.RegisterEnvelope(name, v)
+	case func(int, string, Map) Any:
+		m.RegisterEnvelope(name, v)
+	case Serializer:
+		m.RegisterSerializer(name, v)
+	case CBOR:
+		m.RegisterCBOR(name, v)
 	}
 }
 
@@ -184,6 +367,7 @@ func (m *Module) RegisterConfig(name string, config Config) {
 	} else if _, ok := m.configs[name]; !ok {
 		m.configs[name] = config
 	}
+	m.registered[name] = m.configs[name]
 }
 
 // RegisterConfigs registers multiple configs.
@@ -202,6 +386,10 @@ func (m *Module) Config(global Map) {
 		return
 	}
 
+	m.configure(global)
+}
+
+func (m *Module) configure(global Map) {
 	if cfgAny, ok := global["web"]; ok {
 		if cfgMap, ok := cfgAny.(Map); ok && cfgMap != nil {
 			root := Map{}
@@ -252,27 +440,53 @@ func (m *Module) Config(global Map) {
 }
 
 func (m *Module) configureCross(conf Map) {
+	m.cross = parseCross(conf, m.cross)
+}
+
+// parseCross overrides the base policy with the config.
+func parseCross(conf Map, cross Cross) Cross {
 	if v, ok := conf["allow"].(bool); ok {
-		m.cross.Allow = v
+		cross.Allow = v
 	}
 	if v, ok := conf["method"].(string); ok {
-		m.cross.Method = v
+		cross.Method = v
 	}
 	if vals := parseStringList(conf["methods"]); len(vals) > 0 {
-		m.cross.Methods = vals
+		cross.Methods = vals
 	}
 	if v, ok := conf["origin"].(string); ok {
-		m.cross.Origin = v
+		cross.Origin = v
 	}
 	if vals := parseStringList(conf["origins"]); len(vals) > 0 {
-		m.cross.Origins = vals
+		cross.Origins = vals
 	}
 	if v, ok := conf["header"].(string); ok {
-		m.cross.Header = v
+		cross.Header = v
 	}
 	if vals := parseStringList(conf["headers"]); len(vals) > 0 {
-		m.cross.Headers = vals
+		cross.Headers = vals
+	}
+	if vals := parseStringList(conf["expose"]); len(vals) > 0 {
+		cross.Expose = vals
 	}
+
+	if paths, ok := conf["paths"].(Map); ok {
+		base := cross
+		base.Paths = nil
+		cross.Paths = make([]CrossPath, 0, len(paths))
+		for pattern, val := range paths {
+			if pathConf, ok := val.(Map); ok {
+				cross.Paths = append(cross.Paths, CrossPath{Path: pattern, Cross: parseCross(pathConf, base)})
+			}
+		}
+		sort.Slice(cross.Paths, func(i, j int) bool {
+			if len(cross.Paths[i].Path) != len(cross.Paths[j].Path) {
+				return len(cross.Paths[i].Path) > len(cross.Paths[j].Path)
+			}
+			return cross.Paths[i].Path < cross.Paths[j].Path
+		})
+	}
+	return cross
 }
 
 func (m *Module) configureRoot(conf Map) {
@@ -283,9 +497,13 @@ func (m *Module) configureRoot(conf Map) {
 
 func (m *Module) configureSite(name string, conf Map) {
 	name = strings.ToLower(name)
-	cfg := mergeConfig(mergeConfig(m.defaultConfig, m.config), m.configs[name])
-	cfg = mergeConfig(cfg, parseConfig(conf))
+	// Only site values are kept, setup merges them over the web config.
+	cfg := mergeConfig(m.configs[name], parseConfig(conf))
 	m.configs[name] = cfg
+
+	if crossMap, ok := conf["cross"].(Map); ok && crossMap != nil {
+		m.crosses[name] = crossMap
+	}
 }
 
 // Setup initializes defaults and sites.
@@ -297,10 +515,24 @@ func (m *Module) Setup() {
 		return
 	}
 
+	m.setup()
+
+	for _, duplicate := range m.duplicates {
+		if m.config.StrictRouting {
+			panic("Invalid web router: " + duplicate)
+		}
+		log.Printf("web router %s", duplicate)
+	}
+}
+
+func (m *Module) setup() {
 	m.config = mergeConfig(m.defaultConfig, m.config)
 	m.applyDefaults(&m.config)
 
-	names := map[string]struct{}{bamgoo.DEFAULT: {}}
+	names := map[string]struct{}{}
+	if !m.config.NoDefault {
+		names[bamgoo.DEFAULT] = struct{}{}
+	}
 	for name := range m.configs {
 		names[name] = struct{}{}
 	}
@@ -335,20 +567,28 @@ func (m *Module) Setup() {
 		m.applyDefaults(&baseCfg)
 		m.applySiteDefaults(name, &baseCfg)
 
+		cross := m.cross
+		if crossMap, ok := m.crosses[name]; ok {
+			cross = parseCross(crossMap, cross)
+		}
+
 		site := &Site{
 			Name:     name,
 			Config:   baseCfg,
-			Cross:    m.cross,
+			Cross:    cross,
 			Setting:  baseCfg.Setting,
 			routers:  make(map[string]Router),
 			filters:  make(map[string]Filter),
 			handlers: make(map[string]Handler),
 		}
 		site.Hosts = m.resolveSiteHosts(name, &site.Config)
+		site.errorPages = loadErrorPages(site.Setting)
 		m.sites[name] = site
 	}
 
-	if _, ok := m.sites[bamgoo.DEFAULT]; !ok {
+	if m.config.NoDefault {
+		m.defaultSite = ""
+	} else if _, ok := m.sites[bamgoo.DEFAULT]; !ok {
 		for name := range m.sites {
 			m.defaultSite = name
 			break
@@ -393,6 +633,11 @@ func (m *Module) Setup() {
 	}
 
 	for _, site := range m.sites {
+		if docs := site.Config.Docs; docs != "" {
+			for name, router := range m.docsRouters(docs) {
+				applyRouter(site, name, router)
+			}
+		}
 		for _, host := range site.Hosts {
 			host = normalizeHost(host)
 			if host == "" {
@@ -408,6 +653,29 @@ func (m *Module) Setup() {
 	}
 }
 
+// routeNames sorts route names by priority, catch-all routes come last
+// so that method routes take precedence.
+func (site *Site) routeNames() []string {
+	names := make([]string, 0, len(site.routerInfos))
+	for name := range site.routerInfos {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi := site.routerInfos[names[i]].Priority
+		pj := site.routerInfos[names[j]].Priority
+		if pi != pj {
+			return pi > pj
+		}
+		ai := strings.Contains(names[i], ".*")
+		aj := strings.Contains(names[j], ".*")
+		if ai != aj {
+			return aj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
 func (m *Module) applyDefaults(cfg *Config) {
 	if cfg.Port <= 0 || cfg.Port > 65535 {
 		cfg.Port = 8080
@@ -430,6 +698,9 @@ func (m *Module) applyDefaults(cfg *Config) {
 	if cfg.Shared == "" {
 		cfg.Shared = "shared"
 	}
+	if cfg.Shutdown == 0 {
+		cfg.Shutdown = time.Second * 5
+	}
 	if cfg.Expire == 0 {
 		cfg.Expire = time.Hour * 24 * 30
 	}
@@ -458,6 +729,16 @@ func (m *Module) applySiteDefaults(name string, cfg *Config) {
 }
 
 func (m *Module) buildSite(site *Site) {
+	site.cache = newHttpCache(defaultCacheSize)
+	if site.Setting != nil {
+		site.accessLog = newAccessLog(site.Setting["accesslog"])
+	}
+	// A rebuilt site keeps its slots, in flight requests still hold them.
+	if n := site.Config.MaxConcurrent; n <= 0 {
+		site.slots = nil
+	} else if cap(site.slots) != n {
+		site.slots = make(chan struct{}, n)
+	}
 	site.routerInfos = make(map[string]Info)
 	for key, router := range site.routers {
 		for i, uri := range router.Uris {
@@ -466,10 +747,17 @@ func (m *Module) buildSite(site *Site) {
 				infoKey = key + "." + strconv.Itoa(i)
 			}
 			site.routerInfos[infoKey] = Info{
+				Site:   site.Name,
 				Method: router.Method,
 				Uri:    uri,
 				Router: key,
+				Name:   router.Name,
 				Args:   router.Args,
+				Sign:   router.Sign,
+				Auth:   router.Auth,
+
+				Priority: router.Priority,
+				Head:     !site.Config.NoAutoHead,
 			}
 		}
 	}
@@ -478,12 +766,20 @@ func (m *Module) buildSite(site *Site) {
 	site.requestFilters = make([]ctxFunc, 0, len(site.filters))
 	site.executeFilters = make([]ctxFunc, 0, len(site.filters))
 	site.responseFilters = make([]ctxFunc, 0, len(site.filters))
+	site.beginFilters = make([]ctxFunc, 0, len(site.filters))
+	site.finishFilters = make([]ctxFunc, 0, len(site.filters))
+	site.phaseFilters = make(map[string][]ctxFunc)
 	for _, filter := range site.filters {
+		filter = scopeFilter(filter)
 		if filter.Serve != nil {
 			site.serveFilters = append(site.serveFilters, filter.Serve)
 		}
 		if filter.Request != nil {
-			site.requestFilters = append(site.requestFilters, filter.Request)
+			if filter.Phase == "" {
+				site.requestFilters = append(site.requestFilters, filter.Request)
+			} else {
+				site.phaseFilters[filter.Phase] = append(site.phaseFilters[filter.Phase], filter.Request)
+			}
 		}
 		if filter.Execute != nil {
 			site.executeFilters = append(site.executeFilters, filter.Execute)
@@ -491,6 +787,12 @@ func (m *Module) buildSite(site *Site) {
 		if filter.Response != nil {
 			site.responseFilters = append(site.responseFilters, filter.Response)
 		}
+		if filter.Begin != nil {
+			site.beginFilters = append(site.beginFilters, filter.Begin)
+		}
+		if filter.Finish != nil {
+			site.finishFilters = append(site.finishFilters, filter.Finish)
+		}
 	}
 
 	site.foundHandlers = make([]ctxFunc, 0, len(site.handlers))
@@ -540,10 +842,11 @@ func (m *Module) Open() {
 		panic("Failed to open web: " + err.Error())
 	}
 
-	for siteName, site := range m.sites {
-		for routeName, info := range site.routerInfos {
+	for _, siteName := range m.siteNames() {
+		site := m.sites[siteName]
+		for _, routeName := range site.routeNames() {
 			fullName := siteName + "." + routeName
-			if err := conn.Register(fullName, info, site.Hosts); err != nil {
+			if err := conn.Register(fullName, site.routerInfos[routeName], site.Hosts); err != nil {
 				panic("Failed to register web route: " + err.Error())
 			}
 		}
@@ -554,6 +857,24 @@ func (m *Module) Open() {
 	m.opened = true
 }
 
+// siteNames orders sites for registration, sites with hosts first, so
+// hostless routes can't shadow them.
+func (m *Module) siteNames() []string {
+	siteNames := make([]string, 0, len(m.sites))
+	for siteName := range m.sites {
+		siteNames = append(siteNames, siteName)
+	}
+	sort.Slice(siteNames, func(i, j int) bool {
+		hi := len(m.sites[siteNames[i]].Hosts) > 0
+		hj := len(m.sites[siteNames[j]].Hosts) > 0
+		if hi != hj {
+			return hi
+		}
+		return siteNames[i] < siteNames[j]
+	})
+	return siteNames
+}
+
 func (m *Module) Start() {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -571,6 +892,44 @@ func (m *Module) Start() {
 	m.started = true
 }
 
+// Maintenance switches maintenance mode, requests get 503 except exempt routes.
+func (m *Module) Maintenance(on bool, exempt ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.maintenance = on
+	m.maintenanceExempt = make([]string, 0, len(exempt))
+	for _, name := range exempt {
+		m.maintenanceExempt = append(m.maintenanceExempt, strings.ToLower(name))
+	}
+}
+
+func (m *Module) inMaintenance(name string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if !m.maintenance {
+		return false
+	}
+	for _, exempt := range m.maintenanceExempt {
+		if name == exempt || strings.HasPrefix(name, exempt+".") {
+			return false
+		}
+	}
+	return true
+}
+
+// Stats returns runtime statistics of the web connection.
+func (m *Module) Stats() Stats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.instance != nil && m.instance.connect != nil {
+		return m.instance.connect.Stats()
+	}
+	return Stats{}
+}
+
 func (m *Module) Stop() {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -582,25 +941,66 @@ func (m *Module) Stop() {
 }
 
 func (m *Module) Close() {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.mutex.RLock()
+	shutdown := m.config.Shutdown
+	m.mutex.RUnlock()
 
+	m.draining.Store(int64(max(shutdown, time.Second)))
+	defer m.draining.Store(0)
+
+	m.mutex.Lock()
 	if !m.opened {
+		m.mutex.Unlock()
 		return
 	}
-
-	if m.instance != nil && m.instance.connect != nil {
-		_ = m.instance.connect.Close()
-		m.instance.connect = nil
+	var connect Connection
+	if m.instance != nil {
+		connect, m.instance.connect = m.instance.connect, nil
 	}
-
 	m.opened = false
+	m.mutex.Unlock()
+
+	// In-flight requests still read the module while the server drains.
+	if connect != nil {
+		_ = connect.Close()
+	}
 }
 
 // Serve implements Delegate to dispatch by host/site.
 func (m *Module) Serve(name string, params Map, res http.ResponseWriter, req *http.Request) {
+	// Requests still coming in while shutting down are told to retry.
+	if after := m.draining.Load(); after > 0 {
+		res.Header().Set("Retry-After", retryAfter(time.Duration(after)))
+		res.Header().Set("Connection", "close")
+		http.Error(res, StatusText(StatusServiceUnavailable), StatusServiceUnavailable)
+		return
+	}
+
 	siteName, routerName := splitPrefix(name)
 
+	m.mutex.RLock()
+	strictHost := m.config.StrictHost
+	site := m.selectSite(siteName, req)
+	m.mutex.RUnlock()
+
+	if strictHost && normalizeHost(req.Host) == "" {
+		http.Error(res, StatusText(StatusBadRequest), StatusBadRequest)
+		return
+	}
+	if site == nil {
+		http.Error(res, StatusText(StatusMisdirectedRequest), StatusMisdirectedRequest)
+		return
+	}
+
+	if name == "" {
+		routerName = ""
+	} else if routerName == "" {
+		routerName = name
+	}
+	site.Serve(routerName, params, res, req)
+}
+
+func (m *Module) selectSite(siteName string, req *http.Request) *Site {
 	selected := ""
 	if siteName != "" && siteName != bamgoo.DEFAULT {
 		if _, ok := m.sites[siteName]; ok {
@@ -611,19 +1011,27 @@ func (m *Module) Serve(name string, params Map, res http.ResponseWriter, req *ht
 		selected = m.resolveSiteByHost(req.Host)
 	}
 	if selected == "" {
+		// Hosts not resolving to a site are misdirected, if configured.
+		if m.config.Misdirected && len(m.siteHosts) > 0 {
+			return nil
+		}
 		selected = m.defaultSite
 	}
-	site := m.sites[selected]
-	if site == nil {
-		return
-	}
+	return m.sites[selected]
+}
 
-	if name == "" {
-		routerName = ""
-	} else if routerName == "" {
-		routerName = name
+// KnownHost implements HostDelegate, reporting if a site serves the host,
+// sites without hosts serve any host.
+func (m *Module) KnownHost(host string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, site := range m.sites {
+		if len(site.Hosts) == 0 {
+			return true
+		}
 	}
-	site.Serve(routerName, params, res, req)
+	return m.resolveSiteByHost(host) != ""
 }
 
 func (m *Module) resolveSiteByHost(host string) string {
@@ -715,34 +1123,82 @@ func parseConfig(conf Map) Config {
 	if v, ok := conf["keyfile"].(string); ok {
 		cfg.KeyFile = v
 	}
+	cfg.parseBool(conf, "debug")
+	cfg.parseBool(conf, "debugheader")
+	if v, ok := conf["language"].(string); ok {
+		cfg.Language = v
+	}
+	cfg.parseBool(conf, "h2c")
 	if v, ok := conf["charset"].(string); ok {
 		cfg.Charset = v
 	}
+	if v, ok := conf["shutdown"]; ok {
+		if d := parseDuration(v); d > 0 {
+			cfg.Shutdown = d
+		}
+	}
+	if v, ok := conf["maxheaderbytes"]; ok {
+		cfg.MaxHeaderBytes = parseInt(v)
+	}
+	if v, ok := conf["maxheaders"]; ok {
+		cfg.MaxHeaders = parseInt(v)
+	}
+	if v, ok := conf["maxconcurrent"]; ok {
+		cfg.MaxConcurrent = parseInt(v)
+	}
+	cfg.parseBool(conf, "prettyjson")
+	cfg.parseBool(conf, "jsonescapehtml")
+	cfg.parseBool(conf, "semicolonquery")
 	if v, ok := conf["cookie"].(string); ok {
 		cfg.Cookie = v
 	}
-	if v, ok := conf["token"].(bool); ok {
-		cfg.Token = v
-	}
+	cfg.parseBool(conf, "token")
 	if v, ok := conf["expire"]; ok {
 		if d := parseDuration(v); d > 0 {
 			cfg.Expire = d
 		}
 	}
-	if v, ok := conf["crypto"].(bool); ok {
-		cfg.Crypto = v
+	cfg.TokenSources = parseStringList(conf["tokensources"])
+	cfg.parseBool(conf, "trace")
+	if v, ok := conf["requestid"].(string); ok {
+		cfg.RequestId = v
+	}
+	cfg.parseBool(conf, "crypto")
+	cfg.Protect = parseStringList(conf["protect"])
+	if v, ok := conf["secret"].(string); ok {
+		cfg.Secret = v
 	}
 	if v, ok := conf["maxage"]; ok {
 		if d := parseDuration(v); d > 0 {
 			cfg.MaxAge = d
 		}
 	}
-	if v, ok := conf["httponly"].(bool); ok {
-		cfg.HttpOnly = v
+	cfg.parseBool(conf, "httponly")
+	if v, ok := conf["maxuploadfiles"]; ok {
+		cfg.MaxUploadFiles = parseInt(v)
+	}
+	if v, ok := conf["maxuploadtotal"]; ok {
+		cfg.MaxUploadTotal = int64(parseInt(v))
+	}
+	cfg.parseBool(conf, "buffered")
+	if v, ok := conf["copybuffersize"]; ok {
+		cfg.CopyBufferSize = parseInt(v)
+	}
+	cfg.parseBool(conf, "strictlength")
+	if v, ok := conf["maxbodysize"]; ok {
+		cfg.MaxBodySize = int64(parseInt(v))
 	}
 	if v, ok := conf["upload"].(string); ok {
 		cfg.Upload = v
 	}
+	cfg.parseBool(conf, "useencodedpath")
+	if v, ok := conf["cleanpath"].(string); ok {
+		cfg.CleanPath = strings.ToLower(v)
+	}
+	cfg.parseBool(conf, "autooptions")
+	cfg.parseBool(conf, "noautohead")
+	cfg.parseBool(conf, "strictrouting")
+	cfg.parseBool(conf, "indexredirect")
 	if v, ok := conf["static"].(string); ok {
 		cfg.Static = v
 	}
@@ -750,14 +1206,106 @@ func parseConfig(conf Map) Config {
 		cfg.Shared = v
 	}
 	cfg.Defaults = parseStringList(conf["defaults"])
+	cfg.SharedDirs = parseStringList(conf["shareddirs"])
+	cfg.parseBool(conf, "devicestatic")
+	cfg.RealIP = parseStringList(conf["realip"])
+	cfg.Proxies = parseStringList(conf["proxies"])
+	if v, ok := conf["handlertimeout"]; ok {
+		cfg.HandlerTimeout = parseDuration(v)
+	}
+	if v, ok := conf["csp"].(string); ok {
+		cfg.CSP = v
+	}
+	if v, ok := conf["favicon"].(string); ok {
+		cfg.Favicon = v
+	}
+	if v, ok := conf["docs"].(string); ok {
+		cfg.Docs = v
+	}
+	cfg.Precedence = parseStringList(conf["precedence"])
+	cfg.parseBool(conf, "misdirected")
+	cfg.parseBool(conf, "stricthost")
+	cfg.parseBool(conf, "nodefault")
+	if v, ok := conf["unmatched"].(string); ok {
+		cfg.Unmatched = v
+	}
 	cfg.Domain = firstString(parseStringList(conf["domain"]))
 	cfg.Domains = parseStringList(conf["domains"])
+	if v, ok := conf["headers"].(Map); ok {
+		cfg.Headers = make(map[string]string, len(v))
+		for key, val := range v {
+			cfg.Headers[key] = fmt.Sprintf("%v", val)
+		}
+	}
 	if v, ok := conf["setting"].(Map); ok {
 		cfg.Setting = v
 	}
 	return cfg
 }
 
+// parseBool sets a bool field from the config, remembering false.
+func (cfg *Config) parseBool(conf Map, key string) {
+	v, ok := conf[key].(bool)
+	if !ok {
+		return
+	}
+	*cfg.boolField(key) = v
+	if !v {
+		if cfg.disabled == nil {
+			cfg.disabled = map[string]bool{}
+		}
+		cfg.disabled[key] = true
+	}
+}
+
+func (cfg *Config) boolField(key string) *bool {
+	switch key {
+	case "debug":
+		return &cfg.Debug
+	case "debugheader":
+		return &cfg.DebugHeader
+	case "h2c":
+		return &cfg.H2C
+	case "prettyjson":
+		return &cfg.PrettyJSON
+	case "jsonescapehtml":
+		return &cfg.JSONEscapeHTML
+	case "semicolonquery":
+		return &cfg.SemicolonQuery
+	case "token":
+		return &cfg.Token
+	case "trace":
+		return &cfg.Trace
+	case "crypto":
+		return &cfg.Crypto
+	case "httponly":
+		return &cfg.HttpOnly
+	case "buffered":
+		return &cfg.Buffered
+	case "strictlength":
+		return &cfg.StrictLength
+	case "useencodedpath":
+		return &cfg.UseEncodedPath
+	case "autooptions":
+		return &cfg.AutoOptions
+	case "noautohead":
+		return &cfg.NoAutoHead
+	case "strictrouting":
+		return &cfg.StrictRouting
+	case "indexredirect":
+		return &cfg.IndexRedirect
+	case "devicestatic":
+		return &cfg.DeviceStatic
+	case "misdirected":
+		return &cfg.Misdirected
+	case "stricthost":
+		return &cfg.StrictHost
+	case "nodefault":
+		return &cfg.NoDefault
+	}
+	panic("Invalid web config: " + key)
+}
+
 func parseDuration(val Any) time.Duration {
 	switch v := val.(type) {
 	case time.Duration:
@@ -776,6 +1324,22 @@ func parseDuration(val Any) time.Duration {
 	return 0
 }
 
+func parseInt(val Any) int {
+	switch v := val.(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case string:
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
 func mergeConfig(baseCfg, newCfg Config) Config {
 	out := baseCfg
 	if newCfg.Driver != "" {
@@ -793,9 +1357,42 @@ func mergeConfig(baseCfg, newCfg Config) Config {
 	if newCfg.KeyFile != "" {
 		out.KeyFile = newCfg.KeyFile
 	}
+	if newCfg.Debug {
+		out.Debug = true
+	}
+	if newCfg.DebugHeader {
+		out.DebugHeader = true
+	}
+	if newCfg.Language != "" {
+		out.Language = newCfg.Language
+	}
+	if newCfg.H2C {
+		out.H2C = true
+	}
 	if newCfg.Charset != "" {
 		out.Charset = newCfg.Charset
 	}
+	if newCfg.PrettyJSON {
+		out.PrettyJSON = true
+	}
+	if newCfg.JSONEscapeHTML {
+		out.JSONEscapeHTML = true
+	}
+	if newCfg.SemicolonQuery {
+		out.SemicolonQuery = true
+	}
+	if newCfg.Shutdown != 0 {
+		out.Shutdown = newCfg.Shutdown
+	}
+	if newCfg.MaxHeaderBytes != 0 {
+		out.MaxHeaderBytes = newCfg.MaxHeaderBytes
+	}
+	if newCfg.MaxHeaders != 0 {
+		out.MaxHeaders = newCfg.MaxHeaders
+	}
+	if newCfg.MaxConcurrent != 0 {
+		out.MaxConcurrent = newCfg.MaxConcurrent
+	}
 	if newCfg.Cookie != "" {
 		out.Cookie = newCfg.Cookie
 	}
@@ -805,18 +1402,69 @@ func mergeConfig(baseCfg, newCfg Config) Config {
 	if newCfg.Expire != 0 {
 		out.Expire = newCfg.Expire
 	}
+	if len(newCfg.TokenSources) > 0 {
+		out.TokenSources = newCfg.TokenSources
+	}
+	if newCfg.Trace {
+		out.Trace = true
+	}
+	if newCfg.RequestId != "" {
+		out.RequestId = newCfg.RequestId
+	}
 	if newCfg.Crypto {
 		out.Crypto = true
 	}
+	if len(newCfg.Protect) > 0 {
+		out.Protect = newCfg.Protect
+	}
+	if newCfg.Secret != "" {
+		out.Secret = newCfg.Secret
+	}
 	if newCfg.MaxAge != 0 {
 		out.MaxAge = newCfg.MaxAge
 	}
 	if newCfg.HttpOnly {
 		out.HttpOnly = true
 	}
+	if newCfg.MaxUploadFiles != 0 {
+		out.MaxUploadFiles = newCfg.MaxUploadFiles
+	}
+	if newCfg.MaxUploadTotal != 0 {
+		out.MaxUploadTotal = newCfg.MaxUploadTotal
+	}
+	if newCfg.Buffered {
+		out.Buffered = true
+	}
+	if newCfg.CopyBufferSize > 0 {
+		out.CopyBufferSize = newCfg.CopyBufferSize
+	}
+	if newCfg.StrictLength {
+		out.StrictLength = true
+	}
+	if newCfg.MaxBodySize != 0 {
+		out.MaxBodySize = newCfg.MaxBodySize
+	}
 	if newCfg.Upload != "" {
 		out.Upload = newCfg.Upload
 	}
+	if newCfg.UseEncodedPath {
+		out.UseEncodedPath = true
+	}
+	if newCfg.CleanPath != "" {
+		out.CleanPath = newCfg.CleanPath
+	}
+	if newCfg.AutoOptions {
+		out.AutoOptions = true
+	}
+	if newCfg.NoAutoHead {
+		out.NoAutoHead = true
+	}
+	if newCfg.StrictRouting {
+		out.StrictRouting = true
+	}
+	if newCfg.IndexRedirect {
+		out.IndexRedirect = true
+	}
 	if newCfg.Static != "" {
 		out.Static = newCfg.Static
 	}
@@ -826,15 +1474,80 @@ func mergeConfig(baseCfg, newCfg Config) Config {
 	if len(newCfg.Defaults) > 0 {
 		out.Defaults = newCfg.Defaults
 	}
+	if len(newCfg.Precedence) > 0 {
+		out.Precedence = newCfg.Precedence
+	}
+	if len(newCfg.SharedDirs) > 0 {
+		out.SharedDirs = newCfg.SharedDirs
+	}
+	if newCfg.DeviceStatic {
+		out.DeviceStatic = true
+	}
+	if len(newCfg.RealIP) > 0 {
+		out.RealIP = newCfg.RealIP
+	}
+	if len(newCfg.Proxies) > 0 {
+		out.Proxies = newCfg.Proxies
+	}
+	if newCfg.HandlerTimeout > 0 {
+		out.HandlerTimeout = newCfg.HandlerTimeout
+	}
+	if newCfg.CSP != "" {
+		out.CSP = newCfg.CSP
+	}
+	if newCfg.Favicon != "" {
+		out.Favicon = newCfg.Favicon
+	}
+	if newCfg.Docs != "" {
+		out.Docs = newCfg.Docs
+	}
+	if newCfg.Misdirected {
+		out.Misdirected = true
+	}
+	if newCfg.StrictHost {
+		out.StrictHost = true
+	}
+	if newCfg.Unmatched != "" {
+		out.Unmatched = newCfg.Unmatched
+	}
+	if newCfg.NoDefault {
+		out.NoDefault = true
+	}
 	if newCfg.Domain != "" {
 		out.Domain = newCfg.Domain
 	}
 	if len(newCfg.Domains) > 0 {
 		out.Domains = newCfg.Domains
 	}
+	if len(newCfg.Headers) > 0 {
+		headers := make(map[string]string, len(out.Headers)+len(newCfg.Headers))
+		for key, val := range out.Headers {
+			headers[key] = val
+		}
+		for key, val := range newCfg.Headers {
+			headers[key] = val
+		}
+		out.Headers = headers
+	}
 	if newCfg.Setting != nil {
 		out.Setting = newCfg.Setting
 	}
+
+	// Bools set false by the new config turn off, the rest stay off
+	// until a later config sets them true.
+	if len(out.disabled) > 0 || len(newCfg.disabled) > 0 {
+		disabled := make(map[string]bool, len(out.disabled)+len(newCfg.disabled))
+		for key := range out.disabled {
+			if !*newCfg.boolField(key) {
+				disabled[key] = true
+			}
+		}
+		for key := range newCfg.disabled {
+			*out.boolField(key) = false
+			disabled[key] = true
+		}
+		out.disabled = disabled
+	}
 	return out
 }
 
@@ -892,7 +1605,23 @@ func normalizeHost(host string) string {
 			host = h
 		}
 	}
-	return strings.TrimSpace(host)
+	host = strings.TrimSuffix(strings.TrimSpace(host), ".")
+	return normalizeIDNA(host)
+}
+
+// normalizeIDNA converts unicode domains to punycode, keeping wildcard prefix.
+func normalizeIDNA(host string) string {
+	if host == "" {
+		return ""
+	}
+	prefix := ""
+	if strings.HasPrefix(host, "*.") {
+		prefix, host = "*.", host[2:]
+	}
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil && ascii != "" {
+		host = ascii
+	}
+	return prefix + host
 }
 
 func splitPrefix(name string) (string, string) {
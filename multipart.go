@@ -0,0 +1,177 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+)
+
+// Multipart streams a multipart/mixed response, each part has its own
+// content type. The response headers are sent with the first part, so
+// set headers and cookies before adding parts.
+type Multipart struct {
+	ctx     *Context
+	writer  *multipart.Writer
+	cache   *httpCacheWriter
+	started bool
+	closed  bool
+}
+
+// Multipart sets a multipart/mixed body and returns its writer, parts are
+// written to the client as they are added.
+func (ctx *Context) Multipart() *Multipart {
+	if mp, ok := ctx.Body.(*Multipart); ok {
+		return mp
+	}
+	ctx.clearBody()
+	mp := &Multipart{ctx: ctx}
+	ctx.Body = mp
+	return mp
+}
+
+// Boundary returns the boundary separating the parts.
+func (mp *Multipart) Boundary() string {
+	mp.init()
+	return mp.writer.Boundary()
+}
+
+// Part adds a part with the content type and extra headers, the returned
+// writer is valid until the next part is added.
+func (mp *Multipart) Part(contentType string, headers ...map[string]string) (io.Writer, error) {
+	if mp.closed {
+		return nil, errors.New("web multipart closed")
+	}
+	mp.begin()
+
+	header := textproto.MIMEHeader{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	for _, hs := range headers {
+		for k, v := range hs {
+			header.Set(k, v)
+		}
+	}
+
+	part, err := mp.writer.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	return &multipartPart{part, http.NewResponseController(mp.ctx.writer)}, nil
+}
+
+// Json adds a json part.
+func (mp *Multipart) Json(data any) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	part, err := mp.Part(fmt.Sprintf("application/json; charset=%v", mp.ctx.Charset()))
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(bytes)
+	return err
+}
+
+// Binary adds a binary part, with an optional filename.
+func (mp *Multipart) Binary(bytes []byte, contentType string, names ...string) error {
+	headers := map[string]string{}
+	if len(names) > 0 && names[0] != "" {
+		name := names[0]
+		headers["Content-Disposition"] = contentDisposition("attachment", name)
+	}
+	part, err := mp.Part(contentType, headers)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(bytes)
+	return err
+}
+
+// Close writes the closing boundary and the trailers, the response phase
+// calls it when the action didn't.
+func (mp *Multipart) Close() error {
+	if mp.closed {
+		return nil
+	}
+	mp.begin()
+	mp.closed = true
+	err := mp.writer.Close()
+
+	ctx := mp.ctx
+	for _, trailer := range ctx.trailers {
+		ctx.writer.Header().Set(trailer[0], trailer[1])
+	}
+	if mp.cache != nil {
+		ctx.site.cached(ctx, mp.cache)
+	}
+	return err
+}
+
+func (mp *Multipart) init() {
+	if mp.writer == nil {
+		mp.writer = multipart.NewWriter(multipartOutput{mp.ctx})
+	}
+}
+
+// begin sends the response headers.
+func (mp *Multipart) begin() {
+	if mp.started {
+		return
+	}
+	mp.started = true
+	mp.init()
+
+	ctx := mp.ctx
+	if ctx.Code <= 0 {
+		ctx.Code = StatusOK
+	}
+	if ctx.cacheKey != "" {
+		mp.cache = &httpCacheWriter{ResponseWriter: ctx.writer}
+		ctx.writer = mp.cache
+	}
+	ctx.site.header(ctx)
+
+	res := ctx.writer
+	for _, trailer := range ctx.trailers {
+		res.Header().Add("Trailer", trailer[0])
+	}
+	res.Header().Set("Content-Type", "multipart/mixed; boundary="+mp.writer.Boundary())
+	res.Header().Del("Content-Length")
+	res.WriteHeader(ctx.Code)
+}
+
+// multipartOutput writes the parts to the response, HEAD gets none.
+type multipartOutput struct {
+	ctx *Context
+}
+
+func (o multipartOutput) Write(p []byte) (int, error) {
+	if o.ctx.Method == HEAD {
+		return len(p), nil
+	}
+	return o.ctx.writer.Write(p)
+}
+
+// multipartPart flushes every write of a part to the client.
+type multipartPart struct {
+	io.Writer
+	controller *http.ResponseController
+}
+
+func (p *multipartPart) Write(b []byte) (int, error) {
+	n, err := p.Writer.Write(b)
+	if err == nil {
+		p.controller.Flush()
+	}
+	return n, err
+}
+
+func (site *Site) bodyMultipart(ctx *Context, body *Multipart) {
+	body.Close()
+}
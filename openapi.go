@@ -0,0 +1,197 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	. "github.com/bamgoo/base"
+)
+
+var openapiParamRegexp = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// openapiAnyMethods are documented for routes serving any method.
+var openapiAnyMethods = []string{"get", "post", "put", "patch", "delete"}
+
+// OpenAPI generates an OpenAPI 3 document of a site's routes, the default
+// site without a name. Sites may share uris, so each has its own document,
+// served from its hosts.
+func (m *Module) OpenAPI(names ...string) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	siteName := m.defaultSite
+	if len(names) > 0 && names[0] != "" {
+		siteName = strings.ToLower(names[0])
+	}
+	site, ok := m.sites[siteName]
+	if !ok {
+		return nil, errors.New("web site not found: " + siteName)
+	}
+
+	paths := Map{}
+	for _, info := range site.Routes() {
+		router := site.routers[info.Router]
+		if router.Setting["docs"] == true {
+			continue
+		}
+		uri := openapiParamRegexp.ReplaceAllString(info.Uri, "{$1}")
+		item, ok := paths[uri].(Map)
+		if !ok {
+			item = Map{}
+			paths[uri] = item
+		}
+
+		methods := []string{strings.ToLower(info.Method)}
+		if info.Method == "" {
+			methods = openapiAnyMethods
+		}
+		for _, method := range methods {
+			// Method routes take precedence over any-method ones.
+			if _, ok := item[method]; ok && info.Method == "" {
+				continue
+			}
+			item[method] = openapiOperation(siteName, info, router, method)
+		}
+	}
+
+	servers := []Map{}
+	for _, host := range site.Hosts {
+		servers = append(servers, Map{"url": "//" + host})
+	}
+
+	doc := Map{
+		"openapi": "3.0.3",
+		"info":    Map{"title": "bamgoo web " + siteName, "version": "1.0.0"},
+		"tags":    []Map{{"name": siteName}},
+		"paths":   paths,
+		"components": Map{
+			"securitySchemes": Map{
+				"bearer": Map{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+	if len(servers) > 0 {
+		doc["servers"] = servers
+	}
+
+	return json.Marshal(doc)
+}
+
+// OpenAPI generates an OpenAPI 3 document of a site's routes.
+func OpenAPI(names ...string) ([]byte, error) {
+	return module.OpenAPI(names...)
+}
+
+func openapiOperation(siteName string, info Info, router Router, method string) Map {
+	operation := Map{
+		"operationId": siteName + "." + info.Router,
+		"tags":        []string{siteName},
+		"responses": Map{
+			"200": Map{"description": StatusText(StatusOK)},
+		},
+	}
+	if info.Method == "" {
+		operation["operationId"] = siteName + "." + info.Router + "." + method
+	}
+	if info.Name != "" {
+		operation["summary"] = info.Name
+	}
+	if router.Desc != "" {
+		operation["description"] = router.Desc
+	}
+	if info.Sign || info.Auth {
+		operation["security"] = []Map{{"bearer": []string{}}}
+	}
+
+	inPath := map[string]bool{}
+	for _, match := range openapiParamRegexp.FindAllStringSubmatch(info.Uri, -1) {
+		inPath[match[1]] = true
+	}
+
+	params := []Map{}
+	props, required := Map{}, []string{}
+
+	keys := make([]string, 0, len(info.Args))
+	for key := range info.Args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		arg := info.Args[key]
+		schema := openapiSchema(arg)
+		if inPath[key] {
+			params = append(params, Map{"name": key, "in": "path", "required": true, "schema": schema})
+			delete(inPath, key)
+		} else if method == "get" || method == "delete" || method == "head" {
+			params = append(params, Map{"name": key, "in": "query", "required": arg.Required, "schema": schema})
+		} else {
+			props[key] = schema
+			if arg.Required {
+				required = append(required, key)
+			}
+		}
+	}
+	for key := range inPath {
+		params = append(params, Map{"name": key, "in": "path", "required": true, "schema": Map{"type": "string"}})
+	}
+
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+	if len(props) > 0 {
+		schema := Map{"type": "object", "properties": props}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		operation["requestBody"] = Map{
+			"content": Map{
+				"application/json":                  Map{"schema": schema},
+				"application/x-www-form-urlencoded": Map{"schema": schema},
+			},
+		}
+	}
+	return operation
+}
+
+func openapiSchema(arg Var) Map {
+	schema := Map{}
+
+	tttt := strings.ToLower(arg.Type)
+	array := false
+	if strings.HasPrefix(tttt, "[") && strings.HasSuffix(tttt, "]") {
+		array = true
+		tttt = strings.TrimSuffix(strings.TrimPrefix(tttt, "["), "]")
+	}
+
+	switch tttt {
+	case "int", "int64", "integer", "number", "long":
+		schema["type"] = "integer"
+	case "float", "float64", "decimal", "double":
+		schema["type"] = "number"
+	case "bool", "boolean":
+		schema["type"] = "boolean"
+	case "map", "json", "object":
+		schema["type"] = "object"
+	case "file":
+		schema["type"] = "string"
+		schema["format"] = "binary"
+	case "date", "datetime", "timestamp":
+		schema["type"] = "string"
+		schema["format"] = "date-time"
+	default:
+		schema["type"] = "string"
+	}
+
+	if arg.Name != "" {
+		schema["title"] = arg.Name
+	}
+
+	if array {
+		return Map{"type": "array", "items": schema}
+	}
+	return schema
+}
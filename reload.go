@@ -0,0 +1,103 @@
+package web
+
+import (
+	"errors"
+
+	. "github.com/bamgoo/base"
+)
+
+// Reconfigure re-parses config and applies it to the running sites.
+// Filters, handlers, cross and static settings take effect on the next
+// request, in-flight requests keep using the sites they started with.
+// Listener changes (driver, host, port, tls) require a restart.
+func (m *Module) Reconfigure(global Map) error {
+	m.mutex.Lock()
+
+	if !m.opened {
+		m.configure(global)
+		m.mutex.Unlock()
+		return nil
+	}
+
+	listen := m.config
+	oldSites := m.sites
+
+	// The new config replaces the old one, removed values are gone.
+	m.config = m.defaultConfig
+	m.configs = make(map[string]Config, len(m.registered))
+	for name, cfg := range m.registered {
+		m.configs[name] = cfg
+	}
+	m.crosses = make(map[string]Map)
+	m.cross = Cross{Allow: true}
+	m.configure(global)
+	m.setup()
+
+	var err error
+	if m.config.Driver != listen.Driver || m.config.Host != listen.Host || m.config.Port != listen.Port ||
+		m.config.CertFile != listen.CertFile || m.config.KeyFile != listen.KeyFile {
+		err = errors.New("web listener changed, restart required")
+	}
+	m.config.Driver = listen.Driver
+	m.config.Host = listen.Host
+	m.config.Port = listen.Port
+	m.config.CertFile = listen.CertFile
+	m.config.KeyFile = listen.KeyFile
+
+	var connect Connection
+	if m.instance != nil {
+		connect = m.instance.connect
+	}
+	if connect == nil {
+		m.mutex.Unlock()
+		return err
+	}
+
+	for _, siteName := range m.siteNames() {
+		site := m.sites[siteName]
+		old := oldSites[siteName]
+		for _, routeName := range site.routeNames() {
+			if old != nil && sameHosts(old.Hosts, site.Hosts) {
+				if _, ok := old.routerInfos[routeName]; ok {
+					continue
+				}
+			}
+			if regErr := connect.Register(siteName+"."+routeName, site.routerInfos[routeName], site.Hosts); regErr != nil {
+				m.mutex.Unlock()
+				return regErr
+			}
+		}
+	}
+
+	// Routes gone from the config stop matching.
+	removed := []string{}
+	for siteName, old := range oldSites {
+		site := m.sites[siteName]
+		for routeName := range old.routerInfos {
+			if site != nil {
+				if _, ok := site.routerInfos[routeName]; ok {
+					continue
+				}
+			}
+			removed = append(removed, siteName+"."+routeName)
+		}
+	}
+	m.mutex.Unlock()
+
+	if unregErr := unregisterRoutes(connect, removed); unregErr != nil {
+		return unregErr
+	}
+	return err
+}
+
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,227 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/bamgoo/bamgoo"
+	. "github.com/bamgoo/base"
+)
+
+type (
+	testDriver struct {
+		connect *testConnect
+	}
+
+	// testConnect records the registered routes.
+	testConnect struct {
+		mutex  sync.Mutex
+		routes map[string]Info
+	}
+)
+
+func (driver *testDriver) Connect(inst *Instance) (Connection, error) {
+	return driver.connect, nil
+}
+
+func (c *testConnect) Open() error                     { return nil }
+func (c *testConnect) Close() error                    { return nil }
+func (c *testConnect) Start() error                    { return nil }
+func (c *testConnect) StartTLS(cert, key string) error { return nil }
+func (c *testConnect) Stats() Stats                    { return Stats{} }
+
+func (c *testConnect) Register(name string, info Info, hosts []string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.routes[name] = info
+	return nil
+}
+
+func (c *testConnect) Unregister(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.routes, name)
+	return nil
+}
+
+func (c *testConnect) names() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	names := make([]string, 0, len(c.routes))
+	for name := range c.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newTestModule() *Module {
+	return &Module{
+		defaultConfig: Config{Driver: "test", Charset: UTF8, Port: 8080, JSONEscapeHTML: true},
+		cross:         Cross{Allow: true},
+		drivers:       make(map[string]Driver),
+		configs:       make(map[string]Config),
+		registered:    make(map[string]Config),
+		crosses:       make(map[string]Map),
+		routers:       make(map[string]Router),
+		routerSources: make(map[string]string),
+		filters:       make(map[string]Filter),
+		handlers:      make(map[string]Handler),
+		sinks:         make(map[string]UploadSink),
+		rollbacks:     make(map[string]UploadRollback),
+		serializers:   make(map[string]Serializer),
+		sites:         make(map[string]*Site),
+		siteHosts:     make(map[string]string),
+		defaultSite:   bamgoo.DEFAULT,
+	}
+}
+
+// openTestModule opens a module on the recording driver.
+func openTestModule(t *testing.T, global Map, routers map[string]Router) (*Module, *testConnect) {
+	t.Helper()
+	connect := &testConnect{routes: map[string]Info{}}
+	m := openModule(t, &testDriver{connect}, global, routers)
+	return m, connect
+}
+
+// openDefaultModule opens a module on the default driver, requests go
+// through its router without a listener.
+func openDefaultModule(t *testing.T, global Map, routers map[string]Router) (*Module, http.Handler) {
+	t.Helper()
+	m := openModule(t, &defaultDriver{}, global, routers)
+	return m, http.HandlerFunc(m.instance.connect.(*defaultConnect).dispatch)
+}
+
+func openModule(t *testing.T, driver Driver, global Map, routers map[string]Router) *Module {
+	t.Helper()
+	m := newTestModule()
+	m.RegisterDriver("test", driver)
+	for name, router := range routers {
+		m.RegisterRouter(name, router)
+	}
+	m.Config(global)
+	m.Setup()
+	m.Open()
+	return m
+}
+
+func TestReconfigureUnregistersRemovedRoutes(t *testing.T) {
+	ping := Router{Uri: "/ping", Method: GET, Action: func(ctx *Context) { ctx.Text("pong") }}
+	m, connect := openTestModule(t, Map{
+		"site": Map{"blog": Map{"domain": "blog.example.com"}},
+	}, map[string]Router{"*.ping": ping})
+
+	if got := connect.names(); len(got) != 2 {
+		t.Fatalf("routes before = %v, want blog and default", got)
+	}
+
+	if err := m.Reconfigure(Map{
+		"web":  Map{"nodefault": true},
+		"site": Map{"blog": Map{"domain": "blog.example.com"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got := connect.names()
+	if len(got) != 1 || got[0] != "blog.ping.*" {
+		t.Fatalf("routes after = %v, want [blog.ping.*]", got)
+	}
+}
+
+func TestReconfigureTurnsBoolsOff(t *testing.T) {
+	m, _ := openTestModule(t, Map{
+		"web":  Map{"debug": true},
+		"site": Map{"blog": Map{"domain": "blog.example.com", "strictlength": true}},
+	}, nil)
+
+	if !m.sites["blog"].Config.Debug || !m.sites["blog"].Config.StrictLength {
+		t.Fatal("bools not set before reconfigure")
+	}
+
+	if err := m.Reconfigure(Map{
+		"web":  Map{"debug": false},
+		"site": Map{"blog": Map{"strictlength": false}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if m.config.Debug {
+		t.Error("web debug still on")
+	}
+	if site := m.sites["blog"]; site.Config.Debug || site.Config.StrictLength {
+		t.Errorf("blog debug=%v strictlength=%v, want both off", site.Config.Debug, site.Config.StrictLength)
+	}
+}
+
+func TestReconfigureWhileServing(t *testing.T) {
+	ping := Router{Uri: "/ping", Method: GET, Action: func(ctx *Context) { ctx.Text("pong") }}
+	m, _ := openTestModule(t, Map{
+		"site": Map{"blog": Map{"domain": "blog.example.com"}},
+	}, map[string]Router{"*.ping": ping})
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req := httptest.NewRequest(http.MethodGet, "http://blog.example.com/ping", nil)
+				res := httptest.NewRecorder()
+				m.Serve("blog.ping.*", Map{}, res, req)
+				if res.Code != http.StatusOK {
+					t.Errorf("status = %d, want 200", res.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := m.Reconfigure(Map{
+			"web":  Map{"debug": i%2 == 0},
+			"site": Map{"blog": Map{"domain": "blog.example.com"}},
+		}); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestReconfigureRemovesConfig(t *testing.T) {
+	ping := Router{Uri: "/ping", Method: GET, Action: func(ctx *Context) { ctx.Text("pong") }}
+	m, connect := openTestModule(t, Map{
+		"site": Map{
+			"blog": Map{"domain": "blog.example.com", "cross": Map{"origins": []string{"https://a.example.com"}}},
+			"shop": Map{"domain": "shop.example.com"},
+		},
+	}, map[string]Router{"*.ping": ping})
+
+	if origins := m.sites["blog"].Cross.Origins; len(origins) != 1 {
+		t.Fatalf("blog origins before = %v", origins)
+	}
+
+	if err := m.Reconfigure(Map{
+		"site": Map{"blog": Map{"domain": "blog.example.com"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if origins := m.sites["blog"].Cross.Origins; len(origins) != 0 {
+		t.Errorf("blog origins after = %v, want none", origins)
+	}
+	if _, ok := m.sites["shop"]; ok {
+		t.Error("the removed shop site is still there")
+	}
+	for _, name := range connect.names() {
+		if name == "shop.ping.*" {
+			t.Error("the removed shop site's route is still registered")
+		}
+	}
+}
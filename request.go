@@ -1,31 +1,54 @@
 package web
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bamgoo/bamgoo"
 	. "github.com/bamgoo/base"
+	"golang.org/x/net/html/charset"
 )
 
 // preprocessing handles token and language.
 func (site *Site) preprocessing(ctx *Context) {
-	token := ""
-	if ctx.site.Config.Cookie != "" {
-		if c, e := ctx.reader.Cookie(ctx.site.Config.Cookie); e == nil {
-			token = c.Value
-		}
+	if limit := ctx.site.Config.MaxHeaders; limit > 0 && len(ctx.reader.Header) > limit {
+		ctx.Status(StatusRequestHeaderFieldsTooLarge)
+		site.response(ctx)
+		return
 	}
-	if vv := ctx.Header("Authorization"); vv != "" {
-		token = strings.TrimPrefix(vv, "Bearer ")
+
+	// Only 100-continue is a known expectation.
+	if expect := ctx.reader.Header.Get("Expect"); expect != "" && !strings.EqualFold(expect, "100-continue") {
+		ctx.Header("Connection", "close")
+		ctx.Status(StatusExpectationFailed)
+		site.response(ctx)
+		return
 	}
 
-	if token != "" {
+	// Reject a too large declared body before reading it, with
+	// Expect: 100-continue the client then never sends the body.
+	if limit := ctx.site.Config.MaxBodySize; limit > 0 && ctx.reader.ContentLength > limit {
+		ctx.Header("Connection", "close")
+		ctx.Status(StatusRequestEntityTooLarge)
+		site.response(ctx)
+		return
+	}
+
+	site.tracing(ctx)
+
+	if token := site.token(ctx); token != "" {
 		ctx.Verify(token)
 	}
 
@@ -59,19 +82,101 @@ func (site *Site) preprocessing(ctx *Context) {
 	ctx.Next()
 }
 
+// token resolves the token from Config.TokenSources in order, header,
+// cookie and query, by default the header then the cookie.
+func (site *Site) token(ctx *Context) string {
+	sources := site.Config.TokenSources
+	if len(sources) == 0 {
+		sources = []string{"header", "cookie"}
+	}
+	for _, source := range sources {
+		kind, name, _ := strings.Cut(source, ":")
+		switch strings.ToLower(kind) {
+		case "header":
+			// Bearer passes the token, other schemes pass scheme and credentials.
+			if scheme, credentials := ctx.authorization(); scheme != "" {
+				if strings.EqualFold(scheme, "Bearer") {
+					return credentials
+				} else if credentials == "" {
+					return scheme
+				}
+				return scheme + " " + credentials
+			}
+		case "cookie":
+			if name == "" {
+				name = site.Config.Cookie
+			}
+			if name != "" {
+				if c, e := ctx.reader.Cookie(name); e == nil && c.Value != "" {
+					return c.Value
+				}
+			}
+		case "query":
+			if name == "" {
+				name = "token"
+			}
+			if val := ctx.reader.URL.Query().Get(name); val != "" {
+				return val
+			}
+		}
+	}
+	return ""
+}
+
 // finding handles static files.
 func (site *Site) finding(ctx *Context) {
+	preflight := ctx.site.Cross.Allow && ctx.Header("Access-Control-Request-Method") != ""
+	if ctx.Name == "" && ctx.Method == OPTIONS && ctx.site.Config.AutoOptions && !preflight {
+		if methods := allowedMethods(ctx.reader.Context()); len(methods) > 0 {
+			ctx.Header("Allow", strings.Join(append(methods, OPTIONS), ", "))
+			ctx.Status(StatusNoContent)
+			return
+		}
+	}
+
 	if ctx.Name == "" {
-		file := resolveStaticFile(ctx.site.Config.Static, ctx.Path, ctx.site.Config.Defaults)
-		if file == "" && module.config.Static != "" && module.config.Shared != "" {
-			sharedRoot := path.Join(module.config.Static, module.config.Shared)
-			file = resolveStaticFile(sharedRoot, ctx.Path, module.config.Defaults)
+		file := ""
+		// Config.DeviceStatic tries the device folder of static first.
+		if device := ctx.DeviceType(); ctx.site.Config.DeviceStatic && device != DeviceDesktop {
+			file = resolveStaticFile(path.Join(ctx.site.Config.Static, device), ctx.Path, ctx.site.Config.Defaults)
+		}
+		if ctx.site.Config.DeviceStatic {
+			ctx.Header("Vary", "User-Agent")
+		}
+		if file == "" {
+			file = resolveStaticFile(ctx.site.Config.Static, ctx.Path, ctx.site.Config.Defaults)
+		}
+		if file == "" {
+			file = resolveSharedFile(ctx.site.Config.SharedDirs, ctx.Path)
 		}
 
 		if file != "" && !strings.Contains(file, "../") {
-			ctx.File(file)
+			if ctx.site.Config.IndexRedirect && isIndexRedirect(ctx.Path, file) {
+				location := ctx.Path + "/"
+				if ctx.reader.URL.RawQuery != "" {
+					location += "?" + ctx.reader.URL.RawQuery
+				}
+				ctx.Header("Location", location)
+				ctx.Status(StatusMovedPermanently, "")
+				return
+			}
+			ctx.staticFile(file)
+			return
+		}
+
+		// The path exists with other methods, answer 405 through failed.
+		if ctx.Method != OPTIONS {
+			if methods := allowedMethods(ctx.reader.Context()); len(methods) > 0 {
+				ctx.Header("Allow", strings.Join(methods, ", "))
+				ctx.Reject(StatusMethodNotAllowed, nil)
+				return
+			}
+		}
+
+		if staticRooted(ctx.site.Config) {
+			site.found(ctx, FoundStatic)
 		} else {
-			ctx.Found()
+			site.found(ctx, FoundRoute)
 		}
 		return
 	}
@@ -82,6 +187,12 @@ func (site *Site) finding(ctx *Context) {
 // crossing handles CORS.
 func (site *Site) crossing(ctx *Context) {
 	cross := ctx.site.Cross
+	for _, scoped := range cross.Paths {
+		if matchGlob(scoped.Path, ctx.Path) {
+			cross = scoped.Cross
+			break
+		}
+	}
 
 	if cross.Allow {
 		origin := ctx.Header("Origin")
@@ -115,7 +226,9 @@ func (site *Site) crossing(ctx *Context) {
 			}
 			if header != "" {
 				ctx.Header("Access-Control-Allow-Headers", header)
-				ctx.Header("Access-Control-Expose-Headers", header)
+			}
+			if len(cross.Expose) > 0 {
+				ctx.Header("Access-Control-Expose-Headers", strings.Join(cross.Expose, ", "))
 			}
 
 			if ctx.Method == OPTIONS {
@@ -150,6 +263,65 @@ func resolveStaticFile(root, requestPath string, defaults []string) string {
 	return target
 }
 
+// resolveSharedFile searches shared roots in order, falling back to the global shared folder.
+func resolveSharedFile(dirs []string, requestPath string) string {
+	if len(dirs) == 0 {
+		if module.config.Shared == "" {
+			return ""
+		}
+		dirs = []string{module.config.Shared}
+	}
+	for _, dir := range dirs {
+		root := dir
+		if !path.IsAbs(root) {
+			if module.config.Static == "" {
+				continue
+			}
+			root = path.Join(module.config.Static, dir)
+		}
+		if file := resolveStaticFile(root, requestPath, module.config.Defaults); file != "" {
+			return file
+		}
+	}
+	return ""
+}
+
+// staticRooted reports if a static or shared root of the site exists,
+// so the static lookup ran and missed, not only the route match.
+func staticRooted(cfg Config) bool {
+	roots := []string{cfg.Static}
+	dirs := cfg.SharedDirs
+	if len(dirs) == 0 {
+		dirs = []string{module.config.Shared}
+	}
+	for _, dir := range dirs {
+		if dir != "" && !path.IsAbs(dir) {
+			if module.config.Static == "" {
+				continue
+			}
+			dir = path.Join(module.config.Static, dir)
+		}
+		roots = append(roots, dir)
+	}
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		if fi, err := os.Stat(root); err == nil && fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// isIndexRedirect reports a directory default document served without trailing slash.
+func isIndexRedirect(requestPath, file string) bool {
+	if requestPath == "" || strings.HasSuffix(requestPath, "/") {
+		return false
+	}
+	return !strings.HasSuffix(file, path.Clean("/"+requestPath))
+}
+
 func splitCSV(v string) []string {
 	parts := strings.Split(v, ",")
 	items := make([]string, 0, len(parts))
@@ -205,6 +377,94 @@ func containsString(vals []string, target string) bool {
 	return false
 }
 
+// consuming enforces the request content type, see Setting["consumes"].
+func (site *Site) consuming(ctx *Context) {
+	if ctx.Setting != nil {
+		if consumes := parseStringList(ctx.Setting["consumes"]); len(consumes) > 0 {
+			ctype := ctx.Header("Content-Type")
+			if ctype != "" || ctx.reader.ContentLength > 0 {
+				if mediaType, _, err := mime.ParseMediaType(ctype); err != nil || !matchMediaTypes(consumes, mediaType) {
+					ctx.Reject(StatusUnsupportedMediaType, nil)
+					return
+				}
+			}
+		}
+	}
+	ctx.Next()
+}
+
+// producing negotiates the response type against Accept, see Setting["produces"].
+func (site *Site) producing(ctx *Context) {
+	if ctx.Setting != nil {
+		if produces := parseStringList(ctx.Setting["produces"]); len(produces) > 0 {
+			if accept := ctx.Header("Accept"); accept != "" && !acceptMediaTypes(accept, produces) {
+				ctx.Reject(StatusNotAcceptable, nil)
+				return
+			}
+		}
+	}
+	ctx.Next()
+}
+
+func acceptMediaTypes(accept string, produces []string) bool {
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v <= 0 {
+				continue
+			}
+		}
+		// Accept may use wildcards too, like */* or text/*.
+		mediaType = strings.ToLower(mediaType)
+		for _, produce := range produces {
+			if matchMediaType(mediaType, routeMediaType(produce)) {
+				return true
+			}
+		}
+		if matchMediaTypes(produces, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMediaTypes matches a media type against route patterns, only the
+// patterns may use wildcards.
+func matchMediaTypes(patterns []string, mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	if strings.Contains(mediaType, "*") {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matchMediaType(routeMediaType(pattern), mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeMediaType turns a route pattern like json into its media type.
+func routeMediaType(pattern string) string {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if !strings.Contains(pattern, "/") {
+		pattern = bamgoo.Mimetype(pattern, pattern)
+	}
+	return pattern
+}
+
+func matchMediaType(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
 // authorizing handles authentication.
 func (site *Site) authorizing(ctx *Context) {
 	if ctx.Config.Sign {
@@ -232,20 +492,13 @@ func (site *Site) parsing(ctx *Context) {
 
 	// URL params
 	for key, val := range ctx.Params {
-		if vv, ok := val.(string); ok {
-			ctx.Value[key] = vv
-		} else if vs, ok := val.([]string); ok && len(vs) > 0 {
-			if len(vs) == 1 {
-				ctx.Value[key] = vs[0]
-			} else {
-				ctx.Value[key] = vs
-			}
-		} else {
-			ctx.Value[key] = fmt.Sprintf("%v", val)
-		}
+		ctx.Value[key] = paramValue(val)
 	}
 
 	// URL query
+	if ctx.site.Config.SemicolonQuery && strings.Contains(req.URL.RawQuery, ";") {
+		req.URL.RawQuery = strings.ReplaceAll(req.URL.RawQuery, ";", "&")
+	}
 	for key, vals := range req.URL.Query() {
 		if len(vals) == 1 {
 			ctx.Query[key] = vals[0]
@@ -256,108 +509,479 @@ func (site *Site) parsing(ctx *Context) {
 		}
 	}
 
-	if ctx.Method != "GET" {
+	// Setting["rawBody"] leaves the body for the action, see ctx.RequestBody.
+	rawBody, _ := ctx.Setting["rawBody"].(bool)
+
+	// Config.StrictLength checks the body read against Content-Length,
+	// chunked bodies have no declared length and are skipped.
+	var counter *lengthReader
+	if ctx.site.Config.StrictLength && !rawBody && req.ContentLength > 0 {
+		counter = &lengthReader{reader: req.Body}
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{counter, req.Body}
+	}
+
+	if ctx.Method != GET && ctx.Method != HEAD && !rawBody {
 		ctype := ctx.Header("Content-Type")
 
 		if strings.Contains(ctype, "json") {
-			body, err := io.ReadAll(req.Body)
-			if err == nil {
-				var jsonBody Map
-				if err := json.Unmarshal(body, &jsonBody); err == nil {
-					for key, val := range jsonBody {
-						ctx.Form[key] = val
-						ctx.Value[key] = val
-					}
-				}
+			jsonBody, err := site.decodeJson(ctx)
+			if err != nil {
+				ctx.Reject(readStatus(err), err)
+				return
+			}
+			for key, val := range jsonBody {
+				ctx.Form[key] = val
+				ctx.Value[key] = val
+			}
+		} else if codec := module.cbor; codec != nil && strings.Contains(ctype, "cbor") {
+			cborBody, err := site.decodeCbor(ctx, codec)
+			if err != nil {
+				ctx.Reject(readStatus(err), err)
+				return
+			}
+			for key, val := range cborBody {
+				ctx.Form[key] = val
+				ctx.Value[key] = val
+			}
+		} else if sink := module.uploadSink(ctx.Setting); isMultipart(ctype, sink != nil) {
+			if !site.multiparting(ctx, sink, module.uploadRollback(ctx.Setting)) {
+				return
 			}
 		} else {
 			// Parse form
-			err := req.ParseMultipartForm(32 << 20)
-			if err != nil {
-				body, err := io.ReadAll(req.Body)
-				if err == nil {
-					ctx.Body = string(body)
-				}
+			req.ParseForm()
+			body, err := io.ReadAll(req.Body)
+			if err == nil {
+				ctx.rawBody = body
+				ctx.Body = string(body)
 			}
 
-			if req.MultipartForm != nil {
-				for key, vals := range req.MultipartForm.Value {
-					if len(vals) == 1 {
-						ctx.Form[key] = vals[0]
-						ctx.Value[key] = vals[0]
-					} else if len(vals) > 1 {
-						ctx.Form[key] = vals
-						ctx.Value[key] = vals
-					}
+			for key, vals := range req.PostForm {
+				if len(vals) == 1 {
+					ctx.Form[key] = vals[0]
+					ctx.Value[key] = vals[0]
+				} else if len(vals) > 1 {
+					ctx.Form[key] = vals
+					ctx.Value[key] = vals
 				}
+			}
+		}
+	}
 
-				// Handle file uploads
-				for key, vs := range req.MultipartForm.File {
-					files := []Map{}
-					for _, f := range vs {
-						if f.Size <= 0 || f.Filename == "" {
-							continue
-						}
+	if counter != nil && counter.mismatch(req.ContentLength) {
+		ctx.Reject(StatusBadRequest, errors.New("body length mismatches Content-Length"))
+		return
+	}
 
-						file, err := f.Open()
-						if err != nil {
-							continue
-						}
+	if len(ctx.site.Config.Precedence) > 0 {
+		site.precedence(ctx, ctx.site.Config.Precedence)
+	}
 
-						ext := ""
-						if idx := strings.LastIndex(f.Filename, "."); idx > 0 {
-							ext = f.Filename[idx+1:]
-						}
+	ctx.Timing.Parse = time.Now()
+	ctx.Next()
+}
 
-						tempfile, err := ctx.uploadFile("upload_*." + ext)
-						if err != nil {
-							file.Close()
-							continue
-						}
+func paramValue(val Any) Any {
+	if vv, ok := val.(string); ok {
+		return vv
+	} else if vs, ok := val.([]string); ok && len(vs) > 0 {
+		if len(vs) == 1 {
+			return vs[0]
+		}
+		return vs
+	}
+	return fmt.Sprintf("%v", val)
+}
 
-						io.Copy(tempfile, file)
-						tempfile.Close()
-						file.Close()
-
-						files = append(files, Map{
-							"name": f.Filename,
-							"type": ext,
-							"mime": f.Header.Get("Content-Type"),
-							"size": f.Size,
-							"file": tempfile.Name(),
-						})
-					}
+// precedence rebuilds ctx.Value from sources listed highest first, the
+// sources are params, query, form and upload. Without the config, the
+// precedence is upload, form, query, params.
+func (site *Site) precedence(ctx *Context, sources []string) {
+	value := Map{}
+	for i := len(sources) - 1; i >= 0; i-- {
+		switch strings.ToLower(sources[i]) {
+		case "params", "param":
+			for k, v := range ctx.Params {
+				value[k] = paramValue(v)
+			}
+		case "query":
+			for k, v := range ctx.Query {
+				value[k] = v
+			}
+		case "form":
+			for k, v := range ctx.Form {
+				value[k] = v
+			}
+		case "upload":
+			for k, v := range ctx.Upload {
+				value[k] = v
+			}
+		}
+	}
+	ctx.Value = value
+}
 
-					if len(files) == 1 {
-						ctx.Upload[key] = files[0]
-						ctx.Value[key] = files[0]
-					} else if len(files) > 1 {
-						ctx.Upload[key] = files
-						ctx.Value[key] = files
-					}
+// maxFormMemory caps the multipart values kept in memory.
+const maxFormMemory = 32 << 20
+
+// isMultipart reports whether the body is read part by part, form data
+// always is, other multipart types only go to an upload sink.
+func isMultipart(ctype string, sink bool) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	return mediaType == "multipart/form-data" || sink && strings.HasPrefix(mediaType, "multipart/")
+}
+
+// multiparting reads the multipart body part by part, files go to the
+// upload sink or to temp files. The upload limits are checked as the parts
+// are read, so an oversized upload stops before writing further files.
+// It rejects the request and returns false on failure, after removing the
+// temp files and rolling back what the sink stored.
+func (site *Site) multiparting(ctx *Context, sink UploadSink, rollback UploadRollback) bool {
+	reader, err := ctx.reader.MultipartReader()
+	if err != nil {
+		ctx.Reject(StatusBadRequest, err)
+		return false
+	}
+
+	detect, fallback := uploadCharset(ctx.Setting)
+	transcode := detect && uploadTranscode(ctx.Setting)
+
+	count, total, memory := 0, int64(0), int64(0)
+
+	forms := map[string][]string{}
+	uploads := map[string][]Map{}
+	failed := func(code int, err error) bool {
+		for _, files := range uploads {
+			for _, upload := range files {
+				if file, ok := upload["file"].(string); ok {
+					os.Remove(file)
 				}
-			} else if req.PostForm != nil {
-				for key, vals := range req.PostForm {
-					if len(vals) == 1 {
-						ctx.Form[key] = vals[0]
-						ctx.Value[key] = vals[0]
-					} else if len(vals) > 1 {
-						ctx.Form[key] = vals
-						ctx.Value[key] = vals
+			}
+		}
+		if rollback != nil {
+			for key, files := range uploads {
+				for _, upload := range files {
+					if ref, ok := upload["ref"].(string); ok && ref != "" {
+						rollback(key, ref)
 					}
 				}
 			}
 		}
+		ctx.Reject(code, err)
+		return false
 	}
 
-	ctx.Next()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return failed(StatusBadRequest, err)
+		}
+
+		key := part.FormName()
+		filename := part.FileName()
+		if filename == "" {
+			body, err := io.ReadAll(io.LimitReader(part, maxFormMemory-memory+1))
+			part.Close()
+			if err != nil {
+				return failed(StatusBadRequest, err)
+			}
+			memory += int64(len(body))
+			if memory > maxFormMemory {
+				return failed(StatusRequestEntityTooLarge, nil)
+			}
+			forms[key] = append(forms[key], string(body))
+			continue
+		}
+
+		count++
+		if limit := site.Config.MaxUploadFiles; limit > 0 && count > limit {
+			part.Close()
+			return failed(StatusRequestEntityTooLarge, nil)
+		}
+
+		ext := ""
+		if idx := strings.LastIndex(filename, "."); idx > 0 {
+			ext = filename[idx+1:]
+		}
+		mimeType := part.Header.Get("Content-Type")
+
+		// Past MaxUploadTotal the reader fails instead of ending, so a sink
+		// does not take the cut stream for a whole file.
+		counter := &countReader{reader: part}
+		if limit := site.Config.MaxUploadTotal; limit > 0 {
+			counter.limited, counter.limit = true, limit-total
+		}
+
+		var upload Map
+		if sink != nil {
+			var ref string
+			ref, err = sink(key, filename, mimeType, counter)
+			upload = Map{"size": counter.size, "ref": ref}
+		} else {
+			upload, err = site.uploadTemp(ctx, counter, ext, mimeType, detect, transcode, fallback)
+		}
+		part.Close()
+
+		// kept before the checks, so a failure removes it as well
+		if upload != nil {
+			upload["name"] = filename
+			upload["type"] = ext
+			upload["mime"] = mimeType
+			uploads[key] = append(uploads[key], upload)
+		}
+
+		total += counter.size
+		if counter.err == errUploadTooLarge {
+			return failed(StatusRequestEntityTooLarge, nil)
+		}
+		if counter.err != nil {
+			return failed(StatusBadRequest, counter.err)
+		}
+		if err != nil {
+			return failed(StatusInternalServerError, fmt.Errorf("upload %s: %w", key, err))
+		}
+	}
+
+	for key, vals := range forms {
+		if len(vals) == 1 {
+			ctx.Form[key] = vals[0]
+			ctx.Value[key] = vals[0]
+		} else if len(vals) > 1 {
+			ctx.Form[key] = vals
+			ctx.Value[key] = vals
+		}
+	}
+	for key, files := range uploads {
+		if len(files) == 1 {
+			ctx.Upload[key] = files[0]
+			ctx.Value[key] = files[0]
+		} else if len(files) > 1 {
+			ctx.Upload[key] = files
+			ctx.Value[key] = files
+		}
+	}
+	return true
+}
+
+// uploadTemp copies an uploaded file into a temp file, text files are
+// detected and transcoded when the charset settings ask for it. Empty
+// files give a nil upload.
+func (site *Site) uploadTemp(ctx *Context, reader io.Reader, ext, mimeType string, detect, transcode bool, fallback string) (Map, error) {
+	tempfile, err := ctx.uploadFile("upload_*." + ext)
+	if err != nil {
+		return nil, err
+	}
+	defer tempfile.Close()
+
+	cset := ""
+	if detect && isTextUpload(mimeType, ext) {
+		buffered := bufio.NewReader(reader)
+		head, _ := buffered.Peek(1024)
+		cset = detectCharset(head, mimeType, fallback)
+
+		reader = buffered
+		if transcode && cset != "utf-8" {
+			if utf8Reader, err := charset.NewReaderLabel(cset, buffered); err == nil {
+				reader = utf8Reader
+				cset = "utf-8"
+			}
+		}
+	}
+
+	buffer := site.copyBuffer()
+	size, err := io.CopyBuffer(tempfile, reader, *buffer)
+	releaseBuffer(buffer)
+	if err != nil || size == 0 {
+		os.Remove(tempfile.Name())
+		return nil, err
+	}
+
+	upload := Map{
+		"size": size,
+		"file": tempfile.Name(),
+	}
+	if cset != "" {
+		upload["charset"] = cset
+	}
+	return upload, nil
+}
+
+// decodeJson decodes the json body as it is read, so MaxBodySize and the
+// request deadline stop it early. The body must hold a single value.
+// Setting["strictJSON"] rejects unknown fields, which are the fields not in
+// the route args or aliases, so a route without args takes no fields.
+func (site *Site) decodeJson(ctx *Context) (Map, error) {
+	var reader io.Reader = &deadlineReader{ctx: ctx.Context(), reader: ctx.reader.Body}
+	if limit := site.Config.MaxBodySize; limit > 0 {
+		reader = http.MaxBytesReader(ctx.writer, io.NopCloser(reader), limit)
+	}
+
+	buffer := &bytes.Buffer{}
+	decoder := json.NewDecoder(io.TeeReader(reader, buffer))
+
+	jsonBody := Map{}
+	err := decoder.Decode(&jsonBody)
+	if err == nil {
+		// the body holds a single value, anything after it is an error
+		var extra json.RawMessage
+		if err = decoder.Decode(&extra); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = errors.New("json: unexpected data after the body")
+		}
+	}
+	ctx.rawBody = buffer.Bytes()
+	if err == io.EOF {
+		return Map{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if strict, _ := ctx.Setting["strictJSON"].(bool); strict {
+		known := map[string]bool{}
+		for key := range ctx.Config.Args {
+			known[key] = true
+		}
+		for _, field := range ctx.Config.Alias {
+			known[field] = true
+		}
+		for key := range jsonBody {
+			if !known[key] {
+				return nil, errors.New("json: unknown field \"" + key + "\"")
+			}
+		}
+	}
+	return jsonBody, nil
+}
+
+// readStatus is 413 when the body went over MaxBodySize, else 400.
+func readStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return StatusRequestEntityTooLarge
+	}
+	return StatusBadRequest
+}
+
+// decodeCbor decodes the cbor body with the registered codec, within
+// MaxBodySize and the request deadline like json.
+func (site *Site) decodeCbor(ctx *Context, codec CBOR) (Map, error) {
+	var reader io.Reader = &deadlineReader{ctx: ctx.Context(), reader: ctx.reader.Body}
+	if limit := site.Config.MaxBodySize; limit > 0 {
+		reader = http.MaxBytesReader(ctx.writer, io.NopCloser(reader), limit)
+	}
+
+	data, err := io.ReadAll(reader)
+	ctx.rawBody = data
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return Map{}, nil
+	}
+
+	cborBody := Map{}
+	if err := codec.Unmarshal(data, &cborBody); err != nil {
+		return nil, err
+	}
+	return cborBody, nil
+}
+
+// deadlineReader stops reading once the request context is done.
+type deadlineReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// lengthReader counts the body read, noting how it ended.
+type lengthReader struct {
+	reader io.Reader
+	size   int64
+	err    error
+}
+
+func (r *lengthReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.size += int64(n)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// mismatch reports a truncated body, or a fully read body of another size.
+func (r *lengthReader) mismatch(length int64) bool {
+	if r.err == io.ErrUnexpectedEOF {
+		return true
+	}
+	return r.err == io.EOF && r.size != length
+}
+
+// errUploadTooLarge fails the upload reader past MaxUploadTotal.
+var errUploadTooLarge = errors.New("upload too large")
+
+// countReader counts the bytes read and keeps the first read error. With
+// a limit it fails with errUploadTooLarge once more bytes are read.
+type countReader struct {
+	reader  io.Reader
+	limited bool
+	limit   int64
+	size    int64
+	err     error
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.limited && int64(len(p)) > r.limit-r.size+1 {
+		p = p[:r.limit-r.size+1]
+	}
+	n, err := r.reader.Read(p)
+	r.size += int64(n)
+	if r.limited && r.size > r.limit {
+		err = errUploadTooLarge
+	}
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
 }
 
 // arguing validates and maps arguments.
 func (site *Site) arguing(ctx *Context) {
 	if ctx.Config.Args != nil {
+		values := ctx.Value
+		if len(ctx.Config.Alias) > 0 {
+			values = Map{}
+			for k, v := range ctx.Value {
+				values[k] = v
+			}
+			for arg, from := range ctx.Config.Alias {
+				if v, ok := ctx.Value[from]; ok {
+					values[arg] = v
+				}
+			}
+		}
+
 		argsValue := Map{}
-		res := bamgoo.Mapping(ctx.Config.Args, ctx.Value, argsValue, ctx.Config.Nullable, false, ctx.Timezone())
+		res := bamgoo.Mapping(ctx.Config.Args, values, argsValue, ctx.Config.Nullable, false, ctx.Timezone())
 		if res != nil && res.Fail() {
 			ctx.Failed(res)
 			return
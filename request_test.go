@@ -0,0 +1,275 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	. "github.com/bamgoo/base"
+)
+
+func TestMatchMediaTypesWildcards(t *testing.T) {
+	cases := []struct {
+		patterns  []string
+		mediaType string
+		want      bool
+	}{
+		{[]string{"application/json"}, "application/json", true},
+		{[]string{"image/*"}, "image/png", true},
+		{[]string{"application/json"}, "*/*", false},
+		{[]string{"application/json"}, "application/*", false},
+	}
+	for _, c := range cases {
+		if got := matchMediaTypes(c.patterns, c.mediaType); got != c.want {
+			t.Errorf("matchMediaTypes(%v, %q) = %v, want %v", c.patterns, c.mediaType, got, c.want)
+		}
+	}
+	if !acceptMediaTypes("text/html, */*;q=0.1", []string{"application/json"}) {
+		t.Error("Accept */* should accept any produced type")
+	}
+}
+
+// multipartBody builds a form with the files, keyed by field name.
+func multipartBody(t *testing.T, files map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		part, err := writer.CreateFormFile(name, name+".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(files[name]))
+	}
+	writer.WriteField("title", "hello")
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+func serveUpload(t *testing.T, m *Module, files map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, ctype := multipartBody(t, files)
+	req := httptest.NewRequest(POST, "/upload", body)
+	req.Header.Set("Content-Type", ctype)
+	res := httptest.NewRecorder()
+	m.Serve("default.upload.*", Map{}, res, req)
+	return res
+}
+
+// uploadRouter records the uploads and form of the request it serves.
+func uploadRouter(uploads Map, setting Map) Router {
+	return Router{
+		Uri: "/upload", Method: POST, Setting: setting,
+		Action: func(ctx *Context) {
+			for k, v := range ctx.Upload {
+				uploads[k] = v
+			}
+			uploads["title"] = ctx.Form["title"]
+			ctx.Text("ok")
+		},
+	}
+}
+
+func TestUploadSink(t *testing.T) {
+	sunk := 0
+	sink := func(field, filename, mime string, reader io.Reader) (string, error) {
+		n, err := io.Copy(io.Discard, reader)
+		sunk += int(n)
+		return "mem://" + filename, err
+	}
+	uploads := Map{}
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"upload": uploadRouter(uploads, Map{"uploadSink": sink}),
+	})
+
+	if res := serveUpload(t, m, map[string]string{"doc": "twelve bytes"}); res.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", res.Code)
+	}
+	doc, _ := uploads["doc"].(Map)
+	if doc["ref"] != "mem://doc.txt" || doc["size"] != int64(12) || sunk != 12 {
+		t.Errorf("upload = %v, sunk %d bytes", doc, sunk)
+	}
+	if uploads["title"] != "hello" {
+		t.Errorf("title = %v, want hello", uploads["title"])
+	}
+}
+
+func TestUploadSinkError(t *testing.T) {
+	sink := func(field, filename, mime string, reader io.Reader) (string, error) {
+		return "", errors.New("store unavailable")
+	}
+	uploads := Map{}
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"upload": uploadRouter(uploads, Map{"uploadSink": sink}),
+	})
+
+	if res := serveUpload(t, m, map[string]string{"doc": "data"}); res.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", res.Code)
+	}
+	if len(uploads) > 0 {
+		t.Error("the action ran despite the failed upload")
+	}
+}
+
+func TestUploadTempFile(t *testing.T) {
+	uploads, content := Map{}, ""
+	router := uploadRouter(uploads, nil)
+	action := router.Action
+	router.Action = func(ctx *Context) {
+		if doc, ok := ctx.Upload["doc"].(Map); ok {
+			data, _ := os.ReadFile(doc["file"].(string))
+			content = string(data)
+		}
+		action(ctx)
+	}
+	m, _ := openTestModule(t, Map{"web": Map{"upload": t.TempDir()}}, map[string]Router{"upload": router})
+
+	if res := serveUpload(t, m, map[string]string{"doc": "twelve bytes", "empty": ""}); res.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", res.Code)
+	}
+	if doc, _ := uploads["doc"].(Map); content != "twelve bytes" || doc["size"] != int64(12) {
+		t.Errorf("upload = %v, content %q", doc, content)
+	}
+	if _, ok := uploads["empty"]; ok {
+		t.Error("the empty file was kept")
+	}
+	if uploads["title"] != "hello" {
+		t.Errorf("title = %v, want hello", uploads["title"])
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	cases := []struct {
+		name   string
+		config Map
+		files  map[string]string
+	}{
+		{"files", Map{"maxuploadfiles": 1}, map[string]string{"a": "one", "b": "two", "c": "three"}},
+		{"total", Map{"maxuploadtotal": 8}, map[string]string{"a": "12345", "b": "67890", "c": "x"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c.config["upload"] = dir
+			uploads := Map{}
+			m, _ := openTestModule(t, Map{"web": c.config}, map[string]Router{
+				"upload": uploadRouter(uploads, nil),
+			})
+
+			if res := serveUpload(t, m, c.files); res.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("status = %d, want 413", res.Code)
+			}
+			if len(uploads) > 0 {
+				t.Error("the action ran despite the exceeded limit")
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+				t.Errorf("%d temp files left behind", len(entries))
+			}
+		})
+	}
+}
+
+func TestUploadSinkLimit(t *testing.T) {
+	stored := map[string]bool{}
+	sink := func(field, filename, mime string, reader io.Reader) (string, error) {
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			return "", err
+		}
+		stored["mem://"+filename] = true
+		return "mem://" + filename, nil
+	}
+	rollback := func(field, ref string) { delete(stored, ref) }
+
+	uploads := Map{}
+	m, _ := openTestModule(t, Map{"web": Map{"maxuploadtotal": 8}}, map[string]Router{
+		"upload": uploadRouter(uploads, Map{"uploadSink": "mem"}),
+	})
+	m.RegisterUploadSink("mem", sink)
+	m.RegisterUploadRollback("mem", rollback)
+
+	res := serveUpload(t, m, map[string]string{"a": "12345", "b": "67890"})
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", res.Code)
+	}
+	if stored["mem://b.txt"] {
+		t.Error("the sink stored the cut upload")
+	}
+	if len(stored) > 0 {
+		t.Errorf("uploads not rolled back: %v", stored)
+	}
+}
+
+func TestDecodeJson(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  Map
+		setting Map
+		body    string
+		want    int
+	}{
+		{"object", nil, nil, `{"name":"bamgoo"}`, http.StatusOK},
+		{"empty", nil, nil, ``, http.StatusOK},
+		{"trailing", nil, nil, `{"name":"bamgoo"} {"admin":true}`, http.StatusBadRequest},
+		{"strict", nil, Map{"strictJSON": true}, `{"admin":true}`, http.StatusBadRequest},
+		{"strictEmpty", nil, Map{"strictJSON": true}, `{}`, http.StatusOK},
+		{"tooLarge", Map{"maxbodysize": 8}, nil, `{"name":"bamgoo"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, _ := openTestModule(t, Map{"web": c.config}, map[string]Router{
+				"json": {Uri: "/json", Method: POST, Setting: c.setting, Action: func(ctx *Context) { ctx.Text("ok") }},
+			})
+			req := httptest.NewRequest(POST, "/json", strings.NewReader(c.body))
+			req.Header.Set("Content-Type", "application/json")
+			res := httptest.NewRecorder()
+			m.Serve("default.json.*", Map{}, res, req)
+			if res.Code != c.want {
+				t.Errorf("status = %d, want %d", res.Code, c.want)
+			}
+		})
+	}
+}
+
+func TestStrictLength(t *testing.T) {
+	cases := []struct {
+		name   string
+		strict bool
+		body   io.Reader
+		length int64
+		want   int
+	}{
+		{"match", true, strings.NewReader("a=1&b=2"), 7, http.StatusOK},
+		{"short", true, strings.NewReader("a=1&b=2"), 12, http.StatusBadRequest},
+		{"long", true, strings.NewReader("a=1&b=2"), 3, http.StatusBadRequest},
+		{"truncated", true, io.MultiReader(strings.NewReader("a=1"), iotest.ErrReader(io.ErrUnexpectedEOF)), 7, http.StatusBadRequest},
+		{"off", false, strings.NewReader("a=1&b=2"), 12, http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, _ := openTestModule(t, Map{"web": Map{"strictlength": c.strict}}, map[string]Router{
+				"form": {Uri: "/form", Method: POST, Action: func(ctx *Context) { ctx.Text("ok") }},
+			})
+			req := httptest.NewRequest(POST, "/form", c.body)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.ContentLength = c.length
+			res := httptest.NewRecorder()
+			m.Serve("default.form.*", Map{}, res, req)
+			if res.Code != c.want {
+				t.Errorf("status = %d, want %d", res.Code, c.want)
+			}
+		})
+	}
+}
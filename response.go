@@ -1,11 +1,17 @@
 package web
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bamgoo/bamgoo"
@@ -37,6 +43,12 @@ type (
 	httpFileBody struct {
 		file string
 		name string
+		// static files found by finding get a content hash etag.
+		static bool
+	}
+	httpServeFileBody struct {
+		file string
+		opts FileOptions
 	}
 	httpBinaryBody struct {
 		bytes []byte
@@ -47,27 +59,164 @@ type (
 		size   int64
 		name   string
 	}
+	httpChunkedBody struct {
+		reader io.Reader
+		name   string
+	}
+	httpSendBody struct {
+		reader io.Reader
+		opts   SendOptions
+	}
+	httpSerializeBody struct {
+		value Any
+		name  string
+	}
+	httpCborBody struct {
+		value Any
+	}
+	httpNdjsonBody struct {
+		values <-chan Any
+	}
 	httpStatusBody string
+
+	// httpBufferedWriter holds the body to send it with Content-Length.
+	httpBufferedWriter struct {
+		http.ResponseWriter
+		code   int
+		buffer bytes.Buffer
+	}
+
+	// httpNoRangeWriter answers Accept-Ranges: none, ServeContent would
+	// advertise bytes.
+	httpNoRangeWriter struct {
+		http.ResponseWriter
+	}
+
+	// httpHeadWriter discards the body of HEAD responses but counts its size.
+	httpHeadWriter struct {
+		http.ResponseWriter
+		code int
+		size int64
+	}
 )
 
+func (w *httpHeadWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *httpHeadWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = StatusOK
+	}
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// Flush is a no-op, headers are sent once the body size is known.
+func (w *httpHeadWriter) Flush() {}
+
+func (w *httpHeadWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *httpHeadWriter) flush() {
+	if w.code == 0 {
+		w.code = StatusOK
+	}
+	if w.size > 0 && w.Header().Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", w.size))
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+func (w httpNoRangeWriter) WriteHeader(code int) {
+	w.Header().Set("Accept-Ranges", "none")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w httpNoRangeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *httpBufferedWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *httpBufferedWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = StatusOK
+	}
+	return w.buffer.Write(p)
+}
+
+func (w *httpBufferedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *httpBufferedWriter) flush() {
+	if w.code == 0 {
+		w.code = StatusOK
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(w.buffer.Len()))
+	w.ResponseWriter.WriteHeader(w.code)
+	w.ResponseWriter.Write(w.buffer.Bytes())
+}
+
 func (site *Site) body(ctx *Context) {
 	if ctx.Code <= 0 {
 		ctx.Code = StatusOK
 	}
 
-	// Write headers
-	for k, v := range ctx.headers {
-		ctx.writer.Header().Set(k, v)
+	// Multipart bodies send their headers with the first part, HEAD,
+	// cache and trailers are handled there.
+	if mp, ok := ctx.Body.(*Multipart); ok {
+		site.bodyMultipart(ctx, mp)
+		return
 	}
 
-	// Write cookies
-	for _, cookie := range ctx.cookies {
-		cookie.Path = "/"
-		cookie.HttpOnly = ctx.site.Config.HttpOnly
-		if ctx.site.Config.MaxAge > 0 {
-			cookie.MaxAge = int(ctx.site.Config.MaxAge.Seconds())
+	// HEAD answers with the headers of the would-be body only. Files are
+	// served by ServeFile, which answers HEAD itself with Content-Length,
+	// Content-Type and Last-Modified, so static HEAD needs no wrapping.
+	if ctx.Method == HEAD && !servesHead(ctx.Body) {
+		writer := &httpHeadWriter{ResponseWriter: ctx.writer}
+		ctx.writer = writer
+		defer writer.flush()
+	}
+
+	if ctx.cacheKey != "" {
+		writer := &httpCacheWriter{ResponseWriter: ctx.writer}
+		ctx.writer = writer
+		defer site.cached(ctx, writer)
+	}
+
+	site.header(ctx)
+
+	if len(ctx.trailers) > 0 {
+		for _, trailer := range ctx.trailers {
+			ctx.writer.Header().Add("Trailer", trailer[0])
 		}
-		http.SetCookie(ctx.writer, &cookie)
+		defer func() {
+			for _, trailer := range ctx.trailers {
+				ctx.writer.Header().Set(trailer[0], trailer[1])
+			}
+		}()
+	}
+
+	if site.notModified(ctx) {
+		ctx.clearBody()
+		ctx.Code = StatusNotModified
+		ctx.writer.WriteHeader(StatusNotModified)
+		return
+	}
+
+	if site.buffered(ctx) {
+		writer := &httpBufferedWriter{ResponseWriter: ctx.writer}
+		ctx.writer = writer
+		defer writer.flush()
 	}
 
 	switch body := ctx.Body.(type) {
@@ -89,17 +238,139 @@ func (site *Site) body(ctx *Context) {
 		site.bodyEcho(ctx, body)
 	case httpFileBody:
 		site.bodyFile(ctx, body)
+	case httpServeFileBody:
+		site.bodyServeFile(ctx, body)
 	case httpBinaryBody:
 		site.bodyBinary(ctx, body)
 	case httpBufferBody:
 		site.bodyBuffer(ctx, body)
+	case httpChunkedBody:
+		site.bodyChunked(ctx, body)
+	case httpSendBody:
+		site.bodySend(ctx, body)
+	case httpSerializeBody:
+		site.bodySerialize(ctx, body)
+	case httpNdjsonBody:
+		site.bodyNdjson(ctx, body)
+	case httpCborBody:
+		site.bodyCbor(ctx, body)
 	case httpStatusBody:
 		site.bodyStatus(ctx, body)
+	case httpCachedBody:
+		site.bodyCached(ctx, body)
 	default:
+		if serializer := module.serializer(ctx.Type); ctx.Body != nil && ctx.Type != "" && serializer != nil {
+			site.bodySerialize(ctx, httpSerializeBody{ctx.Body, ctx.Type})
+			return
+		}
 		site.bodyDefault(ctx)
 	}
 }
 
+// header writes the context headers and cookies, only once, because a
+// streaming body may have sent them already.
+func (site *Site) header(ctx *Context) {
+	if ctx.headed {
+		return
+	}
+	ctx.headed = true
+
+	// Config headers go first, content headers belong to the body.
+	for k, v := range ctx.site.Config.Headers {
+		switch http.CanonicalHeaderKey(k) {
+		case "Content-Type", "Content-Length", "Content-Encoding":
+			continue
+		}
+		ctx.writer.Header().Set(k, v)
+	}
+
+	// Write headers
+	for k, v := range ctx.headers {
+		ctx.writer.Header().Set(k, v)
+	}
+
+	if len(ctx.timings) > 0 {
+		ctx.writer.Header().Set("Server-Timing", strings.Join(ctx.timings, ", "))
+	}
+
+	if len(ctx.preloads) > 0 {
+		ctx.writer.Header().Add("Link", strings.Join(ctx.preloads, ", "))
+	}
+
+	// Write cookies
+	for _, cookie := range ctx.cookies {
+		if cookie.Path == "" {
+			cookie.Path = "/"
+		}
+		if ctx.site.Config.HttpOnly {
+			cookie.HttpOnly = true
+		}
+		if cookie.MaxAge == 0 && ctx.site.Config.MaxAge > 0 {
+			cookie.MaxAge = int(ctx.site.Config.MaxAge.Seconds())
+		}
+		prefixCookie(&cookie)
+		http.SetCookie(ctx.writer, &cookie)
+	}
+}
+
+// servesHead reports bodies answering HEAD on their own.
+func servesHead(body Any) bool {
+	switch body.(type) {
+	case httpFileBody, httpServeFileBody:
+		return true
+	}
+	return false
+}
+
+// buffered reports if the body is buffered for a Content-Length, with
+// Config.Buffered or Setting["buffered"], only for non-streaming bodies.
+func (site *Site) buffered(ctx *Context) bool {
+	buffered := site.Config.Buffered
+	if vv, ok := ctx.Setting["buffered"].(bool); ok {
+		buffered = vv
+	}
+	if !buffered || len(ctx.trailers) > 0 {
+		return false
+	}
+	switch ctx.Body.(type) {
+	case string, Map, httpTextBody, httpHtmlBody, httpJsonBody, httpJsonpBody, httpEchoBody:
+		return true
+	}
+	return false
+}
+
+// notModified checks If-Modified-Since against the recorded modification time.
+func (site *Site) notModified(ctx *Context) bool {
+	if ctx.modified.IsZero() || (ctx.Method != GET && ctx.Method != HEAD) {
+		return false
+	}
+	if ctx.Code != StatusOK {
+		return false
+	}
+	since := ctx.reader.Header.Get("If-Modified-Since")
+	if since == "" {
+		return false
+	}
+	t, err := http.ParseTime(since)
+	if err != nil {
+		return false
+	}
+	return !ctx.modified.Truncate(time.Second).After(t)
+}
+
+// prefixCookie enforces the attributes mandated by __Host- and __Secure- names.
+func prefixCookie(cookie *http.Cookie) {
+	name := strings.ToLower(cookie.Name)
+	if strings.HasPrefix(name, "__secure-") {
+		cookie.Secure = true
+	}
+	if strings.HasPrefix(name, "__host-") {
+		cookie.Secure = true
+		cookie.Path = "/"
+		cookie.Domain = ""
+	}
+}
+
 func (site *Site) bodyDefault(ctx *Context) {
 	if ctx.Code <= 0 {
 		ctx.Code = StatusNotFound
@@ -135,7 +406,7 @@ func (site *Site) bodyText(ctx *Context, body httpTextBody) {
 	}
 
 	mimeType := bamgoo.Mimetype(ctx.Type, "text/plain")
-	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.Charset()))
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
 
 	res.WriteHeader(ctx.Code)
 	fmt.Fprint(res, body.text)
@@ -149,7 +420,14 @@ func (site *Site) bodyHtml(ctx *Context, body httpHtmlBody) {
 	}
 
 	mimeType := bamgoo.Mimetype(ctx.Type, "text/html")
-	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.Charset()))
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
+
+	if csp := ctx.site.Config.CSP; csp != "" && res.Header().Get("Content-Security-Policy") == "" {
+		if strings.Contains(csp, "{nonce}") {
+			csp = strings.ReplaceAll(csp, "{nonce}", ctx.CSPNonce())
+		}
+		res.Header().Set("Content-Security-Policy", csp)
+	}
 
 	res.WriteHeader(ctx.Code)
 	fmt.Fprint(res, body.html)
@@ -162,14 +440,14 @@ func (site *Site) bodyJson(ctx *Context, body httpJsonBody) {
 		ctx.Type = "json"
 	}
 
-	bytes, err := json.Marshal(body.json)
+	bytes, err := site.marshalJson(body.json)
 	if err != nil {
 		http.Error(res, err.Error(), StatusInternalServerError)
 		return
 	}
 
-	mimeType := bamgoo.Mimetype(ctx.Type, "application/json")
-	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.Charset()))
+	mimeType := site.jsonMimetype(ctx.Type)
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
 	res.WriteHeader(ctx.Code)
 	fmt.Fprint(res, string(bytes))
 }
@@ -181,20 +459,59 @@ func (site *Site) bodyJsonp(ctx *Context, body httpJsonpBody) {
 		ctx.Type = "script"
 	}
 
-	bytes, err := json.Marshal(body.json)
+	bytes, err := site.marshalJson(body.json)
 	if err != nil {
 		http.Error(res, err.Error(), StatusInternalServerError)
 		return
 	}
 
 	mimeType := bamgoo.Mimetype(ctx.Type, "application/javascript")
-	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.Charset()))
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
 
 	res.WriteHeader(ctx.Code)
 	fmt.Fprintf(res, "%s(%s);", body.callback, string(bytes))
 }
 
+// jsonMimetype resolves the json content type, Setting["jsonMime"] overrides the default.
+func (site *Site) jsonMimetype(tttt string) string {
+	if strings.Contains(tttt, "/") {
+		return tttt
+	}
+	if tttt == "json" && site.Setting != nil {
+		for _, key := range []string{"jsonMime", "jsonmime"} {
+			if vv, ok := site.Setting[key].(string); ok && vv != "" {
+				return vv
+			}
+		}
+	}
+	return bamgoo.Mimetype(tttt, "application/json")
+}
+
+func (site *Site) marshalJson(data Any) ([]byte, error) {
+	if !site.Config.JSONEscapeHTML {
+		buf := &bytes.Buffer{}
+		encoder := json.NewEncoder(buf)
+		encoder.SetEscapeHTML(false)
+		if site.Config.PrettyJSON {
+			encoder.SetIndent("", "  ")
+		}
+		if err := encoder.Encode(data); err != nil {
+			return nil, err
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+	}
+	if site.Config.PrettyJSON {
+		return json.MarshalIndent(data, "", "  ")
+	}
+	return json.Marshal(data)
+}
+
 func (site *Site) bodyEcho(ctx *Context, body httpEchoBody) {
+	if envelope := module.envelope; envelope != nil {
+		site.bodyJson(ctx, httpJsonBody{envelope(body.code, body.text, body.data)})
+		return
+	}
+
 	result := Map{
 		"code": body.code,
 		"time": time.Now().Unix(),
@@ -211,6 +528,21 @@ func (site *Site) bodyEcho(ctx *Context, body httpEchoBody) {
 	site.bodyJson(ctx, httpJsonBody{result})
 }
 
+// contentDisposition is the Content-Disposition of a named download, with
+// an ascii filename for old clients and the UTF-8 filename* for the rest.
+func contentDisposition(disposition, name string) string {
+	plain := strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r < 0x20 || r == 0x7f {
+			return -1
+		}
+		if r > 0x7f {
+			return '_'
+		}
+		return r
+	}, name)
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, plain, url.PathEscape(name))
+}
+
 func (site *Site) bodyFile(ctx *Context, body httpFileBody) {
 	req, res := ctx.reader, ctx.writer
 
@@ -219,15 +551,68 @@ func (site *Site) bodyFile(ctx *Context, body httpFileBody) {
 	}
 
 	mimeType := bamgoo.Mimetype(ctx.Type, "application/octet-stream")
-	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.Charset()))
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
 
 	if body.name != "" {
-		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v;", url.QueryEscape(body.name)))
+		res.Header().Set("Content-Disposition", contentDisposition("attachment", body.name))
+	}
+
+	if body.static {
+		if etag := fileETagOf(body.file); etag != "" {
+			res.Header().Set("ETag", etag)
+		}
 	}
 
 	http.ServeFile(res, req, body.file)
 }
 
+func (site *Site) bodyServeFile(ctx *Context, body httpServeFileBody) {
+	req, res := ctx.reader, ctx.writer
+
+	file, err := os.Open(body.file)
+	if err != nil {
+		http.NotFound(res, req)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(res, req)
+		return
+	}
+
+	if ctx.Type == "" {
+		ctx.Type = "file"
+	}
+
+	mimeType := bamgoo.Mimetype(ctx.Type, "application/octet-stream")
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
+
+	disposition := "attachment"
+	if body.opts.Inline {
+		disposition = "inline"
+	}
+	name := body.opts.Name
+	if name == "" {
+		name = stat.Name()
+	}
+	res.Header().Set("Content-Disposition", contentDisposition(disposition, name))
+
+	if body.opts.MaxAge > 0 {
+		res.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(body.opts.MaxAge.Seconds())))
+	}
+
+	if body.opts.NoRange {
+		req = req.Clone(req.Context())
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+		res = httpNoRangeWriter{res}
+	}
+
+	http.ServeContent(res, req, name, stat.ModTime(), file)
+}
+
 func (site *Site) bodyBinary(ctx *Context, body httpBinaryBody) {
 	res := ctx.writer
 
@@ -236,16 +621,95 @@ func (site *Site) bodyBinary(ctx *Context, body httpBinaryBody) {
 	}
 
 	mimeType := bamgoo.Mimetype(ctx.Type, "application/octet-stream")
-	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.Charset()))
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
 
 	if body.name != "" {
-		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v;", url.QueryEscape(body.name)))
+		res.Header().Set("Content-Disposition", contentDisposition("attachment", body.name))
+	}
+
+	// Ranges only apply to full responses, ServeContent handles Range and
+	// the conditional headers against the ETag and ctx.LastModified. The
+	// ETag is only hashed for requests sending one of them.
+	// Setting["noRange"] disables ranges like FileOptions.NoRange.
+	if ctx.Code == StatusOK && (ctx.Method == GET || ctx.Method == HEAD) {
+		req := ctx.reader
+		noRange, _ := ctx.Setting["noRange"].(bool)
+		if noRange {
+			if req.Header.Get("Range") != "" {
+				req = req.Clone(req.Context())
+				req.Header.Del("Range")
+			}
+			res = httpNoRangeWriter{res}
+		}
+
+		if conditionalRequest(req) {
+			if res.Header().Get("ETag") == "" {
+				sum := sha256.Sum256(body.bytes)
+				res.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+			}
+			http.ServeContent(res, req, "", ctx.modified, bytes.NewReader(body.bytes))
+			return
+		}
+		if !noRange {
+			res.Header().Set("Accept-Ranges", "bytes")
+		}
 	}
 
 	res.WriteHeader(ctx.Code)
 	res.Write(body.bytes)
 }
 
+// conditionalRequest reports a Range or conditional header, which need
+// ServeContent to answer.
+func conditionalRequest(req *http.Request) bool {
+	for _, header := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if req.Header.Get(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (site *Site) bodySend(ctx *Context, body httpSendBody) {
+	req, res := ctx.reader, ctx.writer
+
+	if closer, ok := body.reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if ctx.Type == "" {
+		ctx.Type = "file"
+	}
+
+	mimeType := bamgoo.Mimetype(ctx.Type, "application/octet-stream")
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
+
+	if name := body.opts.Name; name != "" {
+		disposition := "attachment"
+		if body.opts.Inline {
+			disposition = "inline"
+		}
+		res.Header().Set("Content-Disposition", contentDisposition(disposition, name))
+	}
+
+	if seeker, ok := body.reader.(io.ReadSeeker); ok && body.opts.Range && ctx.Code == StatusOK {
+		http.ServeContent(res, req, "", body.opts.ModTime, seeker)
+		return
+	}
+
+	if !body.opts.ModTime.IsZero() {
+		res.Header().Set("Last-Modified", body.opts.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if body.opts.Size > 0 && len(ctx.trailers) == 0 {
+		res.Header().Set("Content-Length", strconv.FormatInt(body.opts.Size, 10))
+	}
+
+	res.WriteHeader(ctx.Code)
+	buffer := site.copyBuffer()
+	io.CopyBuffer(res, body.reader, *buffer)
+	releaseBuffer(buffer)
+}
+
 func (site *Site) bodyBuffer(ctx *Context, body httpBufferBody) {
 	res := ctx.writer
 
@@ -254,17 +718,146 @@ func (site *Site) bodyBuffer(ctx *Context, body httpBufferBody) {
 	}
 
 	mimeType := bamgoo.Mimetype(ctx.Type, "application/octet-stream")
-	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.Charset()))
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
 
 	if body.name != "" {
-		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v;", url.QueryEscape(body.name)))
+		res.Header().Set("Content-Disposition", contentDisposition("attachment", body.name))
 	}
 
-	if body.size > 0 {
+	// Trailers need a chunked body, so no content length then.
+	if body.size > 0 && len(ctx.trailers) == 0 {
 		res.Header().Set("Content-Length", fmt.Sprintf("%d", body.size))
 	}
 
 	res.WriteHeader(ctx.Code)
-	io.Copy(res, body.buffer)
+	buffer := site.copyBuffer()
+	io.CopyBuffer(res, body.buffer, *buffer)
+	releaseBuffer(buffer)
 	body.buffer.Close()
 }
+
+func (site *Site) bodyChunked(ctx *Context, body httpChunkedBody) {
+	res := ctx.writer
+
+	if closer, ok := body.reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if ctx.Type == "" {
+		ctx.Type = "file"
+	}
+
+	mimeType := bamgoo.Mimetype(ctx.Type, "application/octet-stream")
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
+
+	if body.name != "" {
+		res.Header().Set("Content-Disposition", contentDisposition("attachment", body.name))
+	}
+	res.Header().Del("Content-Length")
+
+	res.WriteHeader(ctx.Code)
+
+	controller := http.NewResponseController(res)
+	pooled := site.copyBuffer()
+	defer releaseBuffer(pooled)
+	buffer := *pooled
+	for {
+		n, err := body.reader.Read(buffer)
+		if n > 0 {
+			if _, werr := res.Write(buffer[:n]); werr != nil {
+				return
+			}
+			controller.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// bodyNdjson writes a json line per value and flushes, until the channel
+// closes or the client goes away. Values failing to encode become an
+// error line, so the stream goes on.
+func (site *Site) bodyNdjson(ctx *Context, body httpNdjsonBody) {
+	res := ctx.writer
+
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	res.Header().Del("Content-Length")
+	res.WriteHeader(ctx.Code)
+
+	controller := http.NewResponseController(res)
+	controller.Flush()
+
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(site.Config.JSONEscapeHTML)
+
+	done := ctx.Context().Done()
+	for {
+		select {
+		case <-done:
+			return
+		case value, ok := <-body.values:
+			if !ok {
+				return
+			}
+			buffer.Reset()
+			if err := encoder.Encode(value); err != nil {
+				buffer.Reset()
+				encoder.Encode(Map{"error": err.Error()})
+			}
+			if _, err := res.Write(buffer.Bytes()); err != nil {
+				return
+			}
+			controller.Flush()
+		}
+	}
+}
+
+// bodyCbor encodes with the registered codec, without one it falls back
+// to json.
+func (site *Site) bodyCbor(ctx *Context, body httpCborBody) {
+	codec := module.cbor
+	if codec == nil {
+		ctx.Type = "json"
+		site.bodyJson(ctx, httpJsonBody{body.value})
+		return
+	}
+
+	bytes, err := codec.Marshal(body.value)
+	if err != nil {
+		ctx.Code = StatusInternalServerError
+		site.bodyDefault(ctx)
+		return
+	}
+
+	res := ctx.writer
+	res.Header().Set("Content-Type", "application/cbor")
+	res.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+	res.WriteHeader(ctx.Code)
+	res.Write(bytes)
+}
+
+// bodySerialize encodes with the registered serializer, a type without
+// one falls back to json.
+func (site *Site) bodySerialize(ctx *Context, body httpSerializeBody) {
+	serializer := module.serializer(body.name)
+	if serializer == nil {
+		ctx.Type = "json"
+		site.bodyJson(ctx, httpJsonBody{body.value})
+		return
+	}
+
+	bytes, err := serializer(body.value)
+	if err != nil {
+		ctx.Code = StatusInternalServerError
+		site.bodyDefault(ctx)
+		return
+	}
+
+	res := ctx.writer
+	mimeType := bamgoo.Mimetype(body.name, "application/octet-stream")
+	res.Header().Set("Content-Type", fmt.Sprintf("%v; charset=%v", mimeType, ctx.responseCharset()))
+	res.WriteHeader(ctx.Code)
+	res.Write(bytes)
+}
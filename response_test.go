@@ -0,0 +1,150 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/bamgoo/base"
+)
+
+func TestMarshalJsonEscapeHTML(t *testing.T) {
+	data := Map{"url": "/a?b=1&c=2"}
+
+	escaped := &Site{Config: Config{JSONEscapeHTML: true}}
+	bytes, err := escaped.marshalJson(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(bytes), `{"url":"/a?b=1\u0026c=2"}`; got != want {
+		t.Errorf("escaped = %s, want %s", got, want)
+	}
+
+	unescaped := &Site{Config: Config{JSONEscapeHTML: false}}
+	bytes, err = unescaped.marshalJson(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(bytes), `{"url":"/a?b=1&c=2"}`; got != want {
+		t.Errorf("unescaped = %s, want %s", got, want)
+	}
+}
+
+func TestReadFromPipe(t *testing.T) {
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"stream": {Uri: "/stream", Method: GET, Action: func(ctx *Context) {
+			reader, writer := io.Pipe()
+			go func() {
+				for i := 0; i < 3; i++ {
+					fmt.Fprintf(writer, "chunk %d\n", i)
+				}
+				writer.Close()
+			}()
+			ctx.ReadFrom(reader)
+		}},
+	})
+
+	res := httptest.NewRecorder()
+	m.Serve("default.stream.*", Map{}, res, httptest.NewRequest(GET, "/stream", nil))
+	if res.Code != http.StatusOK || res.Body.String() != "chunk 0\nchunk 1\nchunk 2\n" {
+		t.Errorf("response = %d %q", res.Code, res.Body.String())
+	}
+	if length := res.Header().Get("Content-Length"); length != "" {
+		t.Errorf("Content-Length = %q, want none", length)
+	}
+	if !res.Flushed {
+		t.Error("the stream was not flushed")
+	}
+}
+
+func TestBinaryRanges(t *testing.T) {
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"binary": {Uri: "/binary", Method: GET, Action: func(ctx *Context) {
+			ctx.Binary([]byte("0123456789"))
+		}},
+		"fixed": {Uri: "/fixed", Method: GET, Setting: Map{"noRange": true}, Action: func(ctx *Context) {
+			ctx.Binary([]byte("0123456789"))
+		}},
+	})
+	serve := func(name, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(GET, "/"+name, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		res := httptest.NewRecorder()
+		m.Serve("default."+name+".*", Map{}, res, req)
+		return res
+	}
+
+	res := serve("binary", "bytes=2-4")
+	if res.Code != http.StatusPartialContent || res.Body.String() != "234" || res.Header().Get("Content-Range") != "bytes 2-4/10" {
+		t.Errorf("range: %d %q %q", res.Code, res.Body.String(), res.Header().Get("Content-Range"))
+	}
+	if res := serve("binary", "bytes=20-30"); res.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable range: %d, want 416", res.Code)
+	}
+
+	res = serve("binary", "")
+	if res.Code != http.StatusOK || res.Body.String() != "0123456789" || res.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("plain: %d %q Accept-Ranges %q", res.Code, res.Body.String(), res.Header().Get("Accept-Ranges"))
+	}
+	if etag := res.Header().Get("ETag"); etag != "" {
+		t.Errorf("plain request hashed an ETag %s", etag)
+	}
+
+	res = serve("fixed", "bytes=2-4")
+	if res.Code != http.StatusOK || res.Body.String() != "0123456789" || res.Header().Get("Accept-Ranges") != "none" {
+		t.Errorf("noRange: %d %q Accept-Ranges %q", res.Code, res.Body.String(), res.Header().Get("Accept-Ranges"))
+	}
+}
+
+func TestMultipartResponse(t *testing.T) {
+	calls := 0
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"parts": {Uri: "/parts", Method: GET, Setting: Map{"cache": "1m"}, Action: func(ctx *Context) {
+			calls++
+			ctx.Trailer("X-Parts", "2")
+			mp := ctx.Multipart()
+			mp.Json(Map{"ok": true})
+			mp.Binary([]byte("data"), "text/plain", `report "final".txt`)
+		}},
+	})
+	serve := func(method string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		m.Serve("default.parts.*", Map{}, res, httptest.NewRequest(method, "/parts", nil))
+		return res
+	}
+
+	res := serve(HEAD)
+	if res.Code != http.StatusOK || res.Body.Len() != 0 {
+		t.Errorf("HEAD: %d with %d body bytes", res.Code, res.Body.Len())
+	}
+
+	res = serve(GET)
+	body := res.Body.String()
+	if !strings.Contains(body, `filename="report final.txt"; filename*=UTF-8''report%20%22final%22.txt`) {
+		t.Errorf("disposition not quoted in %q", body)
+	}
+	if res.Header().Get("Trailer") != "X-Parts" || res.Result().Trailer.Get("X-Parts") != "2" {
+		t.Errorf("trailer = %q %v", res.Header().Get("Trailer"), res.Result().Trailer)
+	}
+
+	if cached := serve(GET); cached.Body.String() != body || calls != 2 {
+		t.Errorf("cached response differs, action ran %d times", calls)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	m, _ := openTestModule(t, Map{}, map[string]Router{
+		"binary": {Uri: "/binary", Method: GET, Action: func(ctx *Context) { ctx.Binary([]byte("data"), "报告 \"1\".txt") }},
+	})
+	res := httptest.NewRecorder()
+	m.Serve("default.binary.*", Map{}, res, httptest.NewRequest(GET, "/binary", nil))
+	want := `attachment; filename="__ 1.txt"; filename*=UTF-8''%E6%8A%A5%E5%91%8A%20%221%22.txt`
+	if got := res.Header().Get("Content-Disposition"); got != want {
+		t.Errorf("disposition = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Trace is the W3C trace context of a request, the span is generated for
+// this request with the incoming span as parent.
+type Trace struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Flags    string
+	State    string
+}
+
+// Traceparent formats the traceparent header of the span.
+func (t *Trace) Traceparent() string {
+	return "00-" + t.TraceID + "-" + t.SpanID + "-" + t.Flags
+}
+
+// Inject sets the trace headers on a downstream request header.
+func (t *Trace) Inject(header http.Header) {
+	header.Set("traceparent", t.Traceparent())
+	if t.State != "" {
+		header.Set("tracestate", t.State)
+	}
+}
+
+// parseTrace parses traceparent, a missing or invalid one starts a trace.
+func parseTrace(traceparent, tracestate string) *Trace {
+	trace := &Trace{SpanID: randomHex(8), Flags: "01"}
+
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) >= 4 && len(parts[0]) == 2 && parts[0] != "ff" &&
+		validHex(parts[1], 32) && validHex(parts[2], 16) && validHex(parts[3], 2) &&
+		(parts[0] != "00" || len(parts) == 4) {
+		trace.TraceID = parts[1]
+		trace.ParentID = parts[2]
+		trace.Flags = parts[3]
+		trace.State = tracestate
+	} else {
+		trace.TraceID = randomHex(16)
+	}
+	return trace
+}
+
+// validHex checks a lowercase hex field, ids must not be all zeros.
+func validHex(val string, size int) bool {
+	if len(val) != size || !isHex(val) {
+		return false
+	}
+	return size == 2 || strings.Trim(val, "0") != ""
+}
+
+func isHex(val string) bool {
+	for _, c := range val {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// tracing sets up the trace and request id, see Config.Trace and
+// Config.RequestId.
+func (site *Site) tracing(ctx *Context) {
+	if site.Config.Trace {
+		trace := parseTrace(ctx.Header("traceparent"), ctx.Header("tracestate"))
+		ctx.trace = trace
+		ctx.Locals["trace"] = trace
+		ctx.Header("traceparent", trace.Traceparent())
+		if trace.State != "" {
+			ctx.Header("tracestate", trace.State)
+		}
+	}
+
+	if name := site.Config.RequestId; name != "" {
+		id := ctx.Header(name)
+		if id == "" || len(id) > 128 {
+			if ctx.trace != nil {
+				id = ctx.trace.TraceID
+			} else {
+				id = randomHex(16)
+			}
+		}
+		ctx.Locals["requestId"] = id
+		ctx.Header(name, id)
+	}
+}